@@ -0,0 +1,273 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/cilium/api/v1/models"
+	clientPkg "github.com/cilium/cilium/pkg/client"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// agentTimeout is how long to wait for the Cilium API to respond.
+	agentTimeout = 10 * time.Second
+
+	// agentConfigPath is the path of the daemon configuration in the
+	// Cilium API.
+	agentConfigPath = "/v1/config"
+)
+
+// agentConfig is the MTU-related subset of the Cilium agent configuration.
+// Empty or zero fields were not reported by the agent.
+type agentConfig struct {
+	// Tunnel is the tunnel protocol between nodes, or encapNone when the
+	// agent is configured for direct routing.
+	Tunnel string `json:"tunnel,omitempty"`
+
+	// Encryption is the encryption between nodes, either encapIPsec,
+	// encapWireGuard or encapNone.
+	Encryption string `json:"encryption,omitempty"`
+
+	DeviceMTU int `json:"deviceMTU,omitempty"`
+	RouteMTU  int `json:"routeMTU,omitempty"`
+
+	// Family is the pod address family setting covering the families
+	// enabled in the node addressing.
+	Family string `json:"family,omitempty"`
+}
+
+// agentConfigStatus holds the fields of the daemon configuration status
+// which newer agents report but which are not part of the API models that
+// this tool is built against.
+type agentConfigStatus struct {
+	Status struct {
+		DeviceMTU              int                    `json:"deviceMTU"`
+		RouteMTU               int                    `json:"routeMTU"`
+		DaemonConfigurationMap map[string]interface{} `json:"daemonConfigurationMap"`
+	} `json:"status"`
+}
+
+// configString returns the value of 'key' in the configuration map as a
+// lowercase string, or an empty string if it is not set.
+func configString(m map[string]interface{}, key string) string {
+	switch v := m[key].(type) {
+	case string:
+		return strings.ToLower(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// configInt returns the value of 'key' in the configuration map as an
+// integer, or 0 if it is not set or not a number.
+func configInt(m map[string]interface{}, key string) int {
+	n, _ := strconv.Atoi(configString(m, key))
+	return n
+}
+
+// newAgentConfig extracts the tunnel mode, encryption and MTUs from the
+// daemon configuration. 'status' holds the fields which are not part of
+// 'config'.
+func newAgentConfig(config *models.DaemonConfiguration, status *agentConfigStatus) *agentConfig {
+	m := make(map[string]interface{})
+	if config.Status != nil {
+		for k, v := range config.Status.Immutable {
+			m[k] = v
+		}
+	}
+	for k, v := range status.Status.DaemonConfigurationMap {
+		m[k] = v
+	}
+
+	result := &agentConfig{
+		DeviceMTU: status.Status.DeviceMTU,
+		RouteMTU:  status.Status.RouteMTU,
+	}
+	if config.Status != nil {
+		result.Family = addressingFamily(config.Status.Addressing)
+	}
+	if result.DeviceMTU == 0 {
+		result.DeviceMTU = configInt(m, "MTU")
+	}
+
+	// Older agents report the tunnel protocol or "disabled" as "Tunnel",
+	// newer ones report "RoutingMode" and "TunnelProtocol" separately.
+	switch routing := configString(m, "RoutingMode"); routing {
+	case "native":
+		result.Tunnel = encapNone
+	case "tunnel":
+		result.Tunnel = configString(m, "TunnelProtocol")
+		if result.Tunnel == "" {
+			result.Tunnel = encapVXLAN
+		}
+	default:
+		switch tunnel := configString(m, "Tunnel"); tunnel {
+		case "":
+		case "disabled", "false":
+			result.Tunnel = encapNone
+		default:
+			result.Tunnel = tunnel
+		}
+	}
+
+	ipsec := configString(m, "EnableIPSec")
+	wireguard := configString(m, "EnableWireguard")
+	switch {
+	case ipsec == "true":
+		result.Encryption = encapIPsec
+	case wireguard == "true":
+		result.Encryption = encapWireGuard
+	case ipsec == "false" || wireguard == "false":
+		result.Encryption = encapNone
+	}
+
+	return result
+}
+
+// getAgentConfig fetches the daemon configuration from the Cilium API.
+// Returns an error if Cilium cannot be reached or the configuration cannot
+// be parsed.
+func getAgentConfig() (*agentConfig, error) {
+	sockPath := strings.TrimPrefix(clientPkg.DefaultSockPath(), "unix://")
+	httpClient := &http.Client{
+		Timeout: agentTimeout,
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", sockPath)
+			},
+		},
+	}
+
+	// The configuration is decoded from the raw response rather than
+	// through the API client, so that fields reported by newer agents
+	// are not lost.
+	resp, err := httpClient.Get("http://localhost" + agentConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s: %s", resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+
+	config := &models.DaemonConfiguration{}
+	if err := json.Unmarshal(body, config); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %s", err)
+	}
+	status := &agentConfigStatus{}
+	if err := json.Unmarshal(body, status); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %s", err)
+	}
+
+	return newAgentConfig(config, status), nil
+}
+
+// encapsulation returns the encapsulation implied by the agent
+// configuration, or an empty string if the tunnel mode is unknown.
+func (a *agentConfig) encapsulation() string {
+	if a.Tunnel == "" {
+		return ""
+	}
+	encaps := []string{}
+	if a.Tunnel != encapNone {
+		encaps = append(encaps, a.Tunnel)
+	}
+	if a.Encryption != "" && a.Encryption != encapNone {
+		encaps = append(encaps, a.Encryption)
+	}
+	if len(encaps) == 0 {
+		return encapNone
+	}
+	return strings.Join(encaps, encapSeparator)
+}
+
+// apply configures the encapsulation from the agent configuration. The
+// device MTU of the agent is resolved along with the other sources of the
+// MTU, see resolveBaseMTU(). Settings which the user explicitly specified on
+// the command line in 'flags' are kept; if they contradict the agent
+// configuration, returns an error unless 'force' is true. Settings from the
+// config file give way to the agent configuration.
+func (a *agentConfig) apply(flags *pflag.FlagSet, force bool) error {
+	var conflicts []string
+
+	if encap := a.encapsulation(); encap != "" {
+		switch {
+		case fromCommandLine(flags, "encapsulation") && encapsulation != encap:
+			conflicts = append(conflicts, fmt.Sprintf(
+				"--encapsulation %s, agent uses %s",
+				encapsulation, encap))
+		case fromCommandLine(flags, "tunnel-overhead") && encap == encapNone &&
+			tunnelOverhead != 0:
+			conflicts = append(conflicts, fmt.Sprintf(
+				"--tunnel-overhead %d, agent uses direct routing",
+				tunnelOverhead))
+		case !fromCommandLine(flags, "encapsulation"):
+			encapsulation = encap
+		}
+	}
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+	if !force {
+		return fmt.Errorf("flags contradict agent configuration: %s",
+			strings.Join(conflicts, "; "))
+	}
+	for _, c := range conflicts {
+		log.Warnf("Ignoring agent configuration: %s", c)
+	}
+	return nil
+}
+
+// tunnelMTU returns the MTU for tunnelled routes, given the MTU computed
+// from the encapsulation. The route MTU reported by the agent takes
+// precedence, unless the user explicitly configured the tunnel on the command
+// line in 'flags'.
+// If the two differ in that case, returns an error unless 'force' is true.
+func (a *agentConfig) tunnelMTU(computed int, flags *pflag.FlagSet, force bool) (int, error) {
+	if a.RouteMTU == 0 || a.RouteMTU == computed {
+		return computed, nil
+	}
+	if !fromCommandLine(flags, "encapsulation") &&
+		!fromCommandLine(flags, "tunnel-overhead") &&
+		!fromCommandLine(flags, "mtu") {
+		return a.RouteMTU, nil
+	}
+	if !force {
+		return 0, fmt.Errorf("flags contradict agent configuration: "+
+			"tunnel MTU %d, agent uses route MTU %d", computed, a.RouteMTU)
+	}
+	log.Warnf("Ignoring agent configuration: tunnel MTU %d, agent uses route MTU %d",
+		computed, a.RouteMTU)
+	return computed, nil
+}
@@ -0,0 +1,511 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// MSS clamping rewrites the MSS option of TCP SYN packets sent via a link,
+// so that connections use segments which fit the tunnel MTU even if the
+// software on either end ignores the route MTU.
+//
+// The rules installed by mtu-update are kept in a dedicated iptables chain
+// or nftables table in each namespace, so that they can be replaced as a
+// whole, listed and removed without touching other rules. Each rule carries
+// a comment describing it, from which the installed rules are read back.
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// clampPod and clampHost select where MSS clamping rules are
+	// installed: in the managed pod namespaces for the pod links, and in
+	// the host namespace for the Cilium devices.
+	clampPod  = "pod"
+	clampHost = "host"
+
+	clampIPTables = "iptables"
+	clampNFTables = "nftables"
+
+	// clampChain is the iptables chain in the mangle table holding the
+	// rules, which is jumped to from POSTROUTING.
+	clampChain = "MTU-UPDATE-MSS"
+
+	// clampTable is the nftables table holding the rules.
+	clampTable = "mtu_update"
+
+	// clampComment prefixes the comment of every rule.
+	clampComment = "mtu-update"
+)
+
+var (
+	clampCmd = &cobra.Command{
+		Use:   "clamp",
+		Short: "Manage the MSS clamping rules installed on the node.",
+	}
+
+	clampListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the MSS clamping rules installed in every namespace.",
+		Run: func(cmd *cobra.Command, args []string) {
+			runClamp(false)
+		},
+	}
+
+	clampRemoveCmd = &cobra.Command{
+		Use:   "remove",
+		Short: "Remove the MSS clamping rules installed in every namespace.",
+		Run: func(cmd *cobra.Command, args []string) {
+			runClamp(true)
+		},
+	}
+
+	// clampBackends are all backends, which are searched for rules when
+	// listing or removing them.
+	clampBackends = []string{clampIPTables, clampNFTables}
+
+	// clampCommentRegexp matches the comments of the rules, see
+	// clampRule.comment().
+	clampCommentRegexp = regexp.MustCompile(clampComment + `:(ipv[46]):([^:"\s]+):([0-9]+)`)
+)
+
+func init() {
+	clampCmd.AddCommand(clampListCmd)
+	clampCmd.AddCommand(clampRemoveCmd)
+	rootCmd.AddCommand(clampCmd)
+}
+
+// clampRule clamps the MSS of TCP SYN packets of a family sent via a link.
+type clampRule struct {
+	family string
+	link   string
+	mss    int
+}
+
+func (r clampRule) String() string {
+	return fmt.Sprintf("%s via %s: MSS %d", r.family, r.link, r.mss)
+}
+
+// comment returns the comment identifying the rule.
+func (r clampRule) comment() string {
+	return fmt.Sprintf("%s:%s:%s:%d", clampComment, r.family, r.link, r.mss)
+}
+
+// parseClampRules returns the rules identified by the comments in the
+// output of listing the installed rules.
+func parseClampRules(output string) []clampRule {
+	result := []clampRule{}
+	for _, m := range clampCommentRegexp.FindAllStringSubmatch(output, -1) {
+		mss, _ := strconv.Atoi(m[3])
+		result = append(result, clampRule{family: m[1], link: m[2], mss: mss})
+	}
+	return result
+}
+
+// clampRules returns the rules clamping the MSS of TCP packets via each of
+// the links to fit the tunnel MTU, for each enabled address family.
+func clampRules(links []string, tunnelMTU int) []clampRule {
+	rules := make([]clampRule, 0, 2*len(links))
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		if !familyEnabled(family) {
+			continue
+		}
+		for _, link := range links {
+			rules = append(rules, clampRule{
+				family: family,
+				link:   link,
+				mss:    tunnelMTU - ipHeaderLen(family) - tcpHeaderLen,
+			})
+		}
+	}
+	return rules
+}
+
+// clampRuleStrings returns the sorted descriptions of the rules.
+func clampRuleStrings(rules []clampRule) []string {
+	result := make([]string, 0, len(rules))
+	for _, r := range rules {
+		result = append(result, r.String())
+	}
+	sort.Strings(result)
+	return result
+}
+
+// clampBackend manages the MSS clamping rules in the network namespace of
+// the calling thread.
+type clampBackend interface {
+	// List returns the installed rules.
+	List() ([]clampRule, error)
+
+	// Install replaces the installed rules with 'rules'.
+	Install(rules []clampRule) error
+
+	// Remove removes all rules, and returns true if there were any.
+	Remove() (bool, error)
+}
+
+func newClampBackend(name string) (clampBackend, error) {
+	switch name {
+	case clampIPTables:
+		return iptablesBackend{}, nil
+	case clampNFTables:
+		return nftablesBackend{}, nil
+	}
+	return nil, fmt.Errorf("unknown MSS clamping backend %q", name)
+}
+
+// runCommand runs the command with 'stdin' as its input, and returns its
+// output. The error includes the error output of the command.
+func runCommand(stdin string, name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s %s: %s: %s", name, strings.Join(args, " "),
+			err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// iptablesBackend manages the rules with iptables and ip6tables.
+type iptablesBackend struct{}
+
+func iptablesCommand(family string) string {
+	if family == familyIPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (b iptablesBackend) run(family string, args ...string) (string, error) {
+	args = append([]string{"-w", "-t", "mangle"}, args...)
+	return runCommand("", iptablesCommand(family), args...)
+}
+
+func (b iptablesBackend) List() ([]clampRule, error) {
+	result := []clampRule{}
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		// The chain does not exist if listing it fails.
+		output, err := b.run(family, "-S", clampChain)
+		if err != nil {
+			continue
+		}
+		result = append(result, parseClampRules(output)...)
+	}
+	return result, nil
+}
+
+func (b iptablesBackend) Install(rules []clampRule) error {
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		familyRules := []clampRule{}
+		for _, r := range rules {
+			if r.family == family {
+				familyRules = append(familyRules, r)
+			}
+		}
+		if len(familyRules) == 0 {
+			if _, err := b.removeFamily(family); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := b.run(family, "-S", clampChain); err != nil {
+			if _, err := b.run(family, "-N", clampChain); err != nil {
+				return err
+			}
+		}
+		if _, err := b.run(family, "-F", clampChain); err != nil {
+			return err
+		}
+		for _, r := range familyRules {
+			if _, err := b.run(family, iptablesRuleArgs(r)...); err != nil {
+				return err
+			}
+		}
+		if _, err := b.run(family, "-C", "POSTROUTING", "-j", clampChain); err != nil {
+			if _, err := b.run(family, "-I", "POSTROUTING", "-j", clampChain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// iptablesRuleArgs returns the iptables arguments appending the rule to the
+// chain.
+func iptablesRuleArgs(r clampRule) []string {
+	return []string{"-A", clampChain, "-o", r.link,
+		"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN",
+		"-m", "comment", "--comment", r.comment(),
+		"-j", "TCPMSS", "--set-mss", strconv.Itoa(r.mss)}
+}
+
+func (b iptablesBackend) removeFamily(family string) (bool, error) {
+	if _, err := b.run(family, "-S", clampChain); err != nil {
+		return false, nil
+	}
+	// The jump may be missing if a previous removal was interrupted.
+	b.run(family, "-D", "POSTROUTING", "-j", clampChain)
+	if _, err := b.run(family, "-F", clampChain); err != nil {
+		return false, err
+	}
+	if _, err := b.run(family, "-X", clampChain); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b iptablesBackend) Remove() (bool, error) {
+	removed := false
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		ok, err := b.removeFamily(family)
+		if err != nil {
+			return removed, err
+		}
+		removed = removed || ok
+	}
+	return removed, nil
+}
+
+// nftablesBackend manages the rules with nft, in a table of the inet family
+// covering both IPv4 and IPv6.
+type nftablesBackend struct{}
+
+func (b nftablesBackend) List() ([]clampRule, error) {
+	// The table does not exist if listing it fails.
+	output, err := runCommand("", "nft", "list", "table", "inet", clampTable)
+	if err != nil {
+		return []clampRule{}, nil
+	}
+	return parseClampRules(output), nil
+}
+
+func (b nftablesBackend) Install(rules []clampRule) error {
+	if len(rules) == 0 {
+		_, err := b.Remove()
+		return err
+	}
+
+	_, err := runCommand(nftablesScript(rules), "nft", "-f", "-")
+	return err
+}
+
+// nftablesScript returns the nft script replacing the table with one holding
+// the rules. Declaring the table before deleting it ensures that the
+// deletion succeeds, so the table is replaced atomically.
+func nftablesScript(rules []clampRule) string {
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "table inet %s\n", clampTable)
+	fmt.Fprintf(&script, "delete table inet %s\n", clampTable)
+	fmt.Fprintf(&script, "table inet %s {\n", clampTable)
+	fmt.Fprintf(&script, "\tchain mss_clamp {\n")
+	fmt.Fprintf(&script, "\t\ttype filter hook postrouting priority -150; policy accept;\n")
+	for _, r := range rules {
+		fmt.Fprintf(&script, "\t\tmeta nfproto %s oifname %q tcp flags & (syn | rst) == syn "+
+			"tcp option maxseg size > %d tcp option maxseg size set %d comment %q\n",
+			r.family, r.link, r.mss, r.mss, r.comment())
+	}
+	fmt.Fprintf(&script, "\t}\n}\n")
+	return script.String()
+}
+
+func (b nftablesBackend) Remove() (bool, error) {
+	if _, err := runCommand("", "nft", "list", "table", "inet", clampTable); err != nil {
+		return false, nil
+	}
+	if _, err := runCommand("", "nft", "delete", "table", "inet", clampTable); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// setClampRules records the replacement of the MSS clamping rules in
+// namespace 'ns' with 'rules', and unless running in dry-run mode or
+// planning the preflight 'p', installs them. Returns a nil change if the
+// installed rules already match.
+func setClampRules(ns *namespace, rules []clampRule, p *preflight) (*change, error) {
+	backend, err := newClampBackend(clampBackendName)
+	if err != nil {
+		return nil, err
+	}
+
+	var installed []clampRule
+	err = ns.do(func() error {
+		installed, err = backend.List()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list MSS clamping rules: %s", err)
+	}
+	want := clampRuleStrings(rules)
+	have := clampRuleStrings(installed)
+	if strings.Join(want, "\n") == strings.Join(have, "\n") {
+		return nil, nil
+	}
+
+	c := &change{
+		Kind:     changeClamp,
+		Class:    clampBackendName,
+		OldRules: have,
+		NewRules: want,
+	}
+	if dryRun || p != nil {
+		return c, nil
+	}
+	if err := changeJournal.record(ns, c); err != nil {
+		return c, err
+	}
+	return c, ns.do(func() error {
+		return backend.Install(rules)
+	})
+}
+
+// removeClampRules removes the MSS clamping rules installed with the
+// backend in namespace 'ns'. Returns true if there were any.
+func removeClampRules(ns *namespace, backendName string) (bool, error) {
+	backend, err := newClampBackend(backendName)
+	if err != nil {
+		return false, err
+	}
+	var removed bool
+	err = ns.do(func() error {
+		removed, err = backend.Remove()
+		return err
+	})
+	return removed, err
+}
+
+// clampEnabled returns true if MSS clamping rules are installed in the
+// namespaces selected by 'target'.
+func clampEnabled(target string) bool {
+	for _, t := range clampTargets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// updatePodClamp installs the MSS clamping rules for the managed pod links
+// in the namespace 'ns', sized for the tunnel MTU. The change is recorded in
+// 'nsr'.
+func updatePodClamp(ns *namespace, tunnelMTU int, nsr *nsReport, p *preflight) error {
+	links := []string{}
+	for _, plr := range nsr.Links {
+		if plr.Endpoint != 0 && plr.Error == "" {
+			links = append(links, plr.Name)
+		}
+	}
+	c, err := setClampRules(ns, clampRules(links, tunnelMTU), p)
+	if c != nil {
+		nsr.Changes = append(nsr.Changes, c)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to set MSS clamping rules: %s", err)
+	}
+	return nil
+}
+
+// updateHostClamp installs the MSS clamping rules for the Cilium devices in
+// the host namespace which are not excluded by their device rule, sized for
+// the tunnel MTU. The outcome is recorded in 'rep'.
+func updateHostClamp(host *namespace, tunnelMTU int, rep *report, p *preflight) error {
+	links := []string{}
+	for _, lr := range rep.HostLinks {
+		if lr.Rule != "" && lr.Rule != ruleSkip {
+			links = append(links, lr.Name)
+		}
+	}
+	c, err := setClampRules(host, clampRules(links, tunnelMTU), p)
+	rep.Clamp = c
+	if err != nil {
+		rep.ClampError = err.Error()
+		return err
+	}
+	if c != nil {
+		logSummary(p, "%s MSS clamping rules for %d local devices", updatedVerb(p),
+			len(links))
+	}
+	return nil
+}
+
+// clampNamespace lists the MSS clamping rules of every backend in namespace
+// 'ns', and removes them if 'remove' is true. Returns the number of rules
+// found, and the number of backends whose rules could not be removed.
+func clampNamespace(ns *namespace, name string, remove bool) (int, int) {
+	found, failed := 0, 0
+	for _, backendName := range clampBackends {
+		backend, _ := newClampBackend(backendName)
+		var rules []clampRule
+		ns.do(func() error {
+			rules, _ = backend.List()
+			return nil
+		})
+		for _, rule := range clampRuleStrings(rules) {
+			fmt.Printf("%s: %s: %s\n", name, backendName, rule)
+		}
+		found += len(rules)
+		if !remove || len(rules) == 0 {
+			continue
+		}
+		if _, err := removeClampRules(ns, backendName); err != nil {
+			log.WithError(err).WithFields(logrus.Fields{
+				"netns":   ns.inode,
+				"backend": backendName,
+			}).Warn("Failed to remove MSS clamping rules")
+			failed++
+		}
+	}
+	return found, failed
+}
+
+// runClamp lists the MSS clamping rules in the host and every namespace
+// reachable from it, and removes them if 'remove' is true.
+func runClamp(remove bool) {
+	if verbose {
+		log.Level = logrus.DebugLevel
+	}
+
+	rootNamespace, namespaces, err := scanNamespaces()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to find network namespaces")
+	}
+	defer closeNamespaces(rootNamespace, namespaces)
+
+	found, failed := clampNamespace(rootNamespace, "Host namespace", remove)
+	for _, ns := range namespaces {
+		f, e := clampNamespace(ns, fmt.Sprintf("Namespace %d (pids %s)",
+			ns.inode, formatPIDs(ns.pids)), remove)
+		found += f
+		failed += e
+	}
+
+	if remove {
+		log.Infof("Removed %d MSS clamping rules, %d failed", found, failed)
+	}
+	if failed > 0 {
+		log.Fatalf("Failed to remove MSS clamping rules in %d namespaces", failed)
+	}
+}
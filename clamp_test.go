@@ -0,0 +1,143 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// iptablesOutput is the output of listing the chain with iptables -S, with
+// a rule which was not installed by mtu-update.
+const iptablesOutput = `-N MTU-UPDATE-MSS
+-A MTU-UPDATE-MSS -o cilium_host -p tcp -m tcp --tcp-flags SYN,RST SYN -m comment --comment "mtu-update:ipv4:cilium_host:1410" -j TCPMSS --set-mss 1410
+-A MTU-UPDATE-MSS -o eth0 -p tcp -m tcp --tcp-flags SYN,RST SYN -m comment --comment mtu-update:ipv4:eth0:1410 -j TCPMSS --set-mss 1410
+-A MTU-UPDATE-MSS -o eth1 -p tcp -m tcp --tcp-flags SYN,RST SYN -m comment --comment "added by hand" -j TCPMSS --clamp-mss-to-pmtu
+`
+
+// ip6tablesOutput is the output of listing the chain with ip6tables -S.
+const ip6tablesOutput = `-N MTU-UPDATE-MSS
+-A MTU-UPDATE-MSS -o cilium_host -p tcp -m tcp --tcp-flags SYN,RST SYN -m comment --comment "mtu-update:ipv6:cilium_host:1390" -j TCPMSS --set-mss 1390
+`
+
+// nftablesOutput is the output of listing the table with nft.
+const nftablesOutput = `table inet mtu_update {
+	chain mss_clamp {
+		type filter hook postrouting priority mangle; policy accept;
+		meta nfproto ipv4 oifname "cilium_host" tcp flags & (syn | rst) == syn tcp option maxseg size > 1410 tcp option maxseg size set 1410 comment "mtu-update:ipv4:cilium_host:1410"
+		meta nfproto ipv6 oifname "cilium_host" tcp flags & (syn | rst) == syn tcp option maxseg size > 1390 tcp option maxseg size set 1390 comment "mtu-update:ipv6:cilium_host:1390"
+		oifname "eth1" tcp flags & (syn | rst) == syn tcp option maxseg size set rt mtu comment "mtu-update"
+	}
+}
+`
+
+func TestParseClampRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		rules  []clampRule
+	}{
+		{name: "empty", rules: []clampRule{}},
+		{name: "iptables", output: iptablesOutput, rules: []clampRule{
+			{family: familyIPv4, link: "cilium_host", mss: 1410},
+			{family: familyIPv4, link: "eth0", mss: 1410},
+		}},
+		{name: "ip6tables", output: ip6tablesOutput, rules: []clampRule{
+			{family: familyIPv6, link: "cilium_host", mss: 1390},
+		}},
+		{name: "nftables", output: nftablesOutput, rules: []clampRule{
+			{family: familyIPv4, link: "cilium_host", mss: 1410},
+			{family: familyIPv6, link: "cilium_host", mss: 1390},
+		}},
+		{name: "other comments", output: `-A MTU-UPDATE-MSS -m comment --comment "mtu-update:ipv5:eth0:1410"
+-A MTU-UPDATE-MSS -m comment --comment "mtu-update:ipv4:eth0:"
+-A MTU-UPDATE-MSS -m comment --comment "mtu-update:ipv4::1410"
+`, rules: []clampRule{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := parseClampRules(tt.output)
+			if !reflect.DeepEqual(rules, tt.rules) {
+				t.Errorf("parsed rules %v, expected %v", rules, tt.rules)
+			}
+		})
+	}
+}
+
+func TestClampRules(t *testing.T) {
+	savedFamily := podFamily
+	defer func() {
+		podFamily = savedFamily
+	}()
+
+	tests := []struct {
+		name      string
+		podFamily string
+		links     []string
+		tunnelMTU int
+		installed string
+		rules     []clampRule
+	}{
+		{name: "ipv4", podFamily: familyIPv4, links: []string{"cilium_host", "eth0"},
+			tunnelMTU: 1450, installed: iptablesOutput, rules: []clampRule{
+				{family: familyIPv4, link: "cilium_host", mss: 1410},
+				{family: familyIPv4, link: "eth0", mss: 1410},
+			}},
+		{name: "dual stack", podFamily: familyDual, links: []string{"cilium_host"},
+			tunnelMTU: 1450, installed: nftablesOutput, rules: []clampRule{
+				{family: familyIPv4, link: "cilium_host", mss: 1410},
+				{family: familyIPv6, link: "cilium_host", mss: 1390},
+			}},
+		{name: "ipv6", podFamily: familyIPv6, links: []string{"cilium_host"},
+			tunnelMTU: 1450, installed: ip6tablesOutput, rules: []clampRule{
+				{family: familyIPv6, link: "cilium_host", mss: 1390},
+			}},
+		{name: "no links", podFamily: familyDual, tunnelMTU: 1450, rules: []clampRule{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			podFamily = tt.podFamily
+			rules := clampRules(tt.links, tt.tunnelMTU)
+			if !reflect.DeepEqual(rules, tt.rules) {
+				t.Fatalf("generated rules %v, expected %v", rules, tt.rules)
+			}
+
+			// The installed rules match the generated ones, so they
+			// are left alone, see setClampRules().
+			want := clampRuleStrings(rules)
+			have := clampRuleStrings(parseClampRules(tt.installed))
+			if !reflect.DeepEqual(want, have) {
+				t.Errorf("installed rules %v, expected %v", have, want)
+			}
+
+			// The generated rules are identified by their comments
+			// once installed.
+			var iptablesRules []string
+			for _, r := range rules {
+				iptablesRules = append(iptablesRules, strings.Join(iptablesRuleArgs(r), " "))
+			}
+			if parsed := parseClampRules(strings.Join(iptablesRules, "\n")); !reflect.DeepEqual(parsed, rules) {
+				t.Errorf("generated iptables rules %v are parsed as %v", iptablesRules, parsed)
+			}
+			script := nftablesScript(rules)
+			if parsed := parseClampRules(script); !reflect.DeepEqual(parsed, rules) {
+				t.Errorf("generated nft script %q is parsed as %v", script, parsed)
+			}
+		})
+	}
+}
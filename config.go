@@ -0,0 +1,262 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const (
+	// configNodesKey holds the per-node overrides in the config file.
+	configNodesKey = "nodes"
+
+	// nodeNameEnv is the environment variable holding the name of the
+	// Kubernetes node, used to look up its labels.
+	nodeNameEnv = "NODE_NAME"
+)
+
+// configSettings records the flags which were applied from the config file.
+// pflag marks them as changed just like flags given on the command line, so
+// this is used to tell the two apart, see fromCommandLine().
+var configSettings = map[string]bool{}
+
+// fromCommandLine returns true if the flag was given on the command line,
+// rather than left at its default or applied from the config file.
+func fromCommandLine(flags *pflag.FlagSet, name string) bool {
+	return flags.Changed(name) && !configSettings[name]
+}
+
+// nodeOverride is an entry of the per-node overrides in the config file. The
+// settings are applied on nodes matching all of the specified selectors.
+type nodeOverride struct {
+	Hostname  string                 `mapstructure:"hostname"`
+	Labels    map[string]string      `mapstructure:"labels"`
+	Interface string                 `mapstructure:"interface"`
+	Settings  map[string]interface{} `mapstructure:"settings"`
+}
+
+// nodeIdentity describes the node for matching against the overrides.
+// Labels and the primary interface are only looked up if an override
+// selects on them.
+type nodeIdentity struct {
+	hostname  string
+	labels    map[string]string
+	iface     string
+	gotLabels bool
+	gotIface  bool
+}
+
+// String returns a human-readable description of the override selectors.
+func (o *nodeOverride) String() string {
+	selectors := []string{}
+	if o.Hostname != "" {
+		selectors = append(selectors, "hostname="+o.Hostname)
+	}
+	for _, k := range sortedKeys(o.Labels) {
+		selectors = append(selectors, fmt.Sprintf("label %s=%s", k, o.Labels[k]))
+	}
+	if o.Interface != "" {
+		selectors = append(selectors, "interface="+o.Interface)
+	}
+	return strings.Join(selectors, ", ")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// nodeLabels fetches the labels of the node named by nodeNameEnv, or by the
+// hostname if it is not set, from the Kubernetes API.
+func nodeLabels(hostname string) (map[string]string, error) {
+	name := os.Getenv(nodeNameEnv)
+	if name == "" {
+		name = hostname
+	}
+	c, err := newKubeClient("")
+	if err != nil {
+		return nil, err
+	}
+	node, err := c.GetNode(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node %s: %s", name, err)
+	}
+	return node.Metadata.Labels, nil
+}
+
+// primaryInterface returns the name of the link of the default route in the
+// host namespace.
+func primaryInterface() (string, error) {
+	host, err := currentNamespace()
+	if err != nil {
+		return "", err
+	}
+	defer host.Close()
+
+	link, err := defaultRouteLink(host)
+	if err != nil {
+		return "", err
+	}
+	return link.Attrs().Name, nil
+}
+
+// matches returns true if the node matches all selectors of the override,
+// looking up the node labels and primary interface as needed.
+func (o *nodeOverride) matches(node *nodeIdentity) (bool, error) {
+	if o.Hostname != "" && o.Hostname != node.hostname {
+		return false, nil
+	}
+	if len(o.Labels) > 0 {
+		if !node.gotLabels {
+			labels, err := nodeLabels(node.hostname)
+			if err != nil {
+				return false, fmt.Errorf("failed to get node labels: %s", err)
+			}
+			node.labels, node.gotLabels = labels, true
+		}
+		for k, v := range o.Labels {
+			if value, ok := node.labels[k]; !ok || value != v {
+				return false, nil
+			}
+		}
+	}
+	if o.Interface != "" {
+		if !node.gotIface {
+			iface, err := primaryInterface()
+			if err != nil {
+				return false, fmt.Errorf("failed to detect primary interface: %s", err)
+			}
+			node.iface, node.gotIface = iface, true
+		}
+		if o.Interface != node.iface {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// readNodeOverrides decodes the per-node overrides from the config file.
+func readNodeOverrides(config *viper.Viper) ([]nodeOverride, error) {
+	overrides := []nodeOverride{}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		ErrorUnused: true,
+		Result:      &overrides,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(config.Get(configNodesKey)); err != nil {
+		return nil, err
+	}
+	for i := range overrides {
+		o := &overrides[i]
+		if o.Hostname == "" && len(o.Labels) == 0 && o.Interface == "" {
+			return nil, fmt.Errorf("override %d has no hostname, labels or interface", i+1)
+		}
+	}
+	return overrides, nil
+}
+
+// configValue formats a setting from the config file as a flag value.
+func configValue(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		values := make([]string, 0, len(list))
+		for _, v := range list {
+			values = append(values, fmt.Sprint(v))
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// loadConfig reads the config file at 'path' and applies its settings to the
+// flags, see applyConfig().
+func loadConfig(path string, flags *pflag.FlagSet) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %s", err)
+	}
+	return applyConfig(path, flags, &nodeIdentity{hostname: hostname})
+}
+
+// applyConfig reads the config file at 'path' and applies its settings to
+// the flags. Keys are flag names. Settings at the top level apply to all
+// nodes, and the settings of each override matching 'node' take precedence,
+// in the order they appear in the file. Flags given on the command line take
+// precedence over the config file.
+func applyConfig(path string, flags *pflag.FlagSet, node *nodeIdentity) error {
+	config := viper.New()
+	config.SetConfigFile(path)
+	if err := config.ReadInConfig(); err != nil {
+		return err
+	}
+
+	settings := config.AllSettings()
+	delete(settings, configNodesKey)
+
+	overrides, err := readNodeOverrides(config)
+	if err != nil {
+		return fmt.Errorf("invalid node overrides: %s", err)
+	}
+	for i := range overrides {
+		o := &overrides[i]
+		ok, err := o.matches(node)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		log.Infof("Applying config overrides for %s", o)
+		for key, value := range o.Settings {
+			settings[strings.ToLower(key)] = value
+		}
+	}
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		flag := flags.Lookup(key)
+		if flag == nil || key == "config" {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if flag.Changed {
+			log.Debugf("Flag --%s overrides config setting", key)
+			continue
+		}
+		value := configValue(settings[key])
+		if err := flags.Set(key, value); err != nil {
+			return fmt.Errorf("invalid value %q for setting %s: %s",
+				value, key, err)
+		}
+		configSettings[key] = true
+		log.Debugf("Config sets --%s=%s", key, value)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// testConfig sets the MTU on all nodes, and overrides it by hostname, node
+// labels and primary interface, in that order.
+const testConfig = `mtu: 9000
+encapsulation: vxlan
+nodes:
+- hostname: node1
+  settings:
+    mtu: 8000
+- labels:
+    node.kubernetes.io/instance-type: m5.large
+  settings:
+    mtu: 9001
+- interface: ens5
+  settings:
+    mtu: 1500
+    encapsulation: geneve
+- hostname: node2
+  labels:
+    topology.kubernetes.io/zone: eu-west-1a
+  settings:
+    tunnel-overhead: 60
+`
+
+// writeConfig writes the config to a file in 'dir', and returns its path.
+func writeConfig(t *testing.T, dir, config string) string {
+	path := filepath.Join(dir, "mtu-update.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newConfigFlags returns a flag set with the flags set by the test configs.
+func newConfigFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.Int("mtu", 1500, "")
+	flags.String("encapsulation", encapVXLAN, "")
+	flags.Int("tunnel-overhead", 50, "")
+	flags.String("config", "", "")
+	return flags
+}
+
+func TestApplyConfig(t *testing.T) {
+	savedSettings := configSettings
+	defer func() {
+		configSettings = savedSettings
+	}()
+
+	dir, err := ioutil.TempDir("", "mtu-update-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeConfig(t, dir, testConfig)
+
+	instanceType := map[string]string{"node.kubernetes.io/instance-type": "m5.large"}
+	tests := []struct {
+		name          string
+		args          []string
+		hostname      string
+		labels        map[string]string
+		iface         string
+		mtu           string
+		encapsulation string
+		overhead      string
+		commandLine   []string
+	}{
+		{name: "no override", hostname: "node0", iface: "eth0",
+			mtu: "9000", encapsulation: encapVXLAN, overhead: "50"},
+		{name: "hostname", hostname: "node1", iface: "eth0",
+			mtu: "8000", encapsulation: encapVXLAN, overhead: "50"},
+		{name: "labels over hostname", hostname: "node1", labels: instanceType, iface: "eth0",
+			mtu: "9001", encapsulation: encapVXLAN, overhead: "50"},
+		{name: "interface over labels", hostname: "node0", labels: instanceType, iface: "ens5",
+			mtu: "1500", encapsulation: encapGeneve, overhead: "50"},
+		{name: "all selectors must match", hostname: "node2", iface: "eth0",
+			mtu: "9000", encapsulation: encapVXLAN, overhead: "50"},
+		{name: "hostname and labels", hostname: "node2", iface: "eth0",
+			labels: map[string]string{"topology.kubernetes.io/zone": "eu-west-1a"},
+			mtu:    "9000", encapsulation: encapVXLAN, overhead: "60"},
+		{name: "command line over config", args: []string{"--mtu=1400"},
+			hostname: "node1", labels: instanceType, iface: "ens5",
+			mtu: "1400", encapsulation: encapGeneve, overhead: "50",
+			commandLine: []string{"mtu"}},
+		{name: "command line over defaults", args: []string{"--tunnel-overhead=70"},
+			hostname: "node0", iface: "eth0",
+			mtu: "9000", encapsulation: encapVXLAN, overhead: "70",
+			commandLine: []string{"tunnel-overhead"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configSettings = map[string]bool{}
+			flags := newConfigFlags()
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			node := &nodeIdentity{
+				hostname:  tt.hostname,
+				labels:    tt.labels,
+				iface:     tt.iface,
+				gotLabels: true,
+				gotIface:  true,
+			}
+			if err := applyConfig(path, flags, node); err != nil {
+				t.Fatalf("failed to apply config: %s", err)
+			}
+
+			for name, value := range map[string]string{
+				"mtu":             tt.mtu,
+				"encapsulation":   tt.encapsulation,
+				"tunnel-overhead": tt.overhead,
+			} {
+				if v := flags.Lookup(name).Value.String(); v != value {
+					t.Errorf("--%s is %s, expected %s", name, v, value)
+				}
+			}
+
+			commandLine := map[string]bool{}
+			for _, name := range tt.commandLine {
+				commandLine[name] = true
+			}
+			flags.VisitAll(func(f *pflag.Flag) {
+				if fromCommandLine(flags, f.Name) != commandLine[f.Name] {
+					t.Errorf("--%s from command line is %t, expected %t",
+						f.Name, !commandLine[f.Name], commandLine[f.Name])
+				}
+			})
+		})
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	savedSettings := configSettings
+	defer func() {
+		configSettings = savedSettings
+	}()
+
+	dir, err := ioutil.TempDir("", "mtu-update-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{name: "unknown setting", config: "mtu: 9000\nmtus: 9000\n"},
+		{name: "config setting", config: "config: other.yaml\n"},
+		{name: "invalid value", config: "mtu: jumbo\n"},
+		{name: "override without selector", config: "nodes:\n- settings:\n    mtu: 9000\n"},
+		{name: "unknown override key", config: "nodes:\n- host: node1\n  settings:\n    mtu: 9000\n"},
+		{name: "unknown setting in override",
+			config: "nodes:\n- hostname: node1\n  settings:\n    mtus: 9000\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configSettings = map[string]bool{}
+			path := writeConfig(t, dir, tt.config)
+			node := &nodeIdentity{hostname: "node1", gotLabels: true, gotIface: true}
+			if err := applyConfig(path, newConfigFlags(), node); err == nil {
+				t.Errorf("config applied, expected an error")
+			}
+		})
+	}
+}
+
+func TestReadNodeOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtu-update-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := viper.New()
+	config.SetConfigFile(writeConfig(t, dir, testConfig))
+	if err := config.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := readNodeOverrides(config)
+	if err != nil {
+		t.Fatalf("failed to read overrides: %s", err)
+	}
+
+	expected := []string{
+		"hostname=node1",
+		"label node.kubernetes.io/instance-type=m5.large",
+		"interface=ens5",
+		"hostname=node2, label topology.kubernetes.io/zone=eu-west-1a",
+	}
+	if len(overrides) != len(expected) {
+		t.Fatalf("read %d overrides, expected %d", len(overrides), len(expected))
+	}
+	for i := range overrides {
+		if s := overrides[i].String(); s != expected[i] {
+			t.Errorf("override %d selects %s, expected %s", i+1, s, expected[i])
+		}
+	}
+}
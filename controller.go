@@ -0,0 +1,369 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// rolloutLabel is set to "true" on the nodes which the controller
+	// has released for updating. The DaemonSet selects nodes with this
+	// label, so its pod only runs on released nodes.
+	rolloutLabel = "mtu-update.cilium.io/update"
+
+	// rolloutAnnotation records the progress of the rollout on each
+	// node, so that an interrupted rollout can be resumed.
+	rolloutAnnotation = "mtu-update.cilium.io/status"
+
+	rolloutInProgress = "in-progress"
+	rolloutDone       = "done"
+	rolloutFailed     = "failed"
+
+	// zoneLabel and zoneLabelDeprecated hold the zone of a node, in
+	// order of preference.
+	zoneLabel           = "topology.kubernetes.io/zone"
+	zoneLabelDeprecated = "failure-domain.beta.kubernetes.io/zone"
+)
+
+var (
+	controllerCmd = &cobra.Command{
+		Use:   "controller",
+		Short: "Roll the MTU update out across the cluster node by node.",
+		Run: func(cmd *cobra.Command, args []string) {
+			runController(cmd)
+		},
+	}
+
+	// k8sAPIServer is the address of the Kubernetes API server. If
+	// empty, the in-cluster configuration is used.
+	k8sAPIServer string
+
+	// rolloutNodeSelector selects the nodes to update.
+	rolloutNodeSelector string
+
+	// rolloutNamespace and rolloutPodSelector select the pods of the
+	// mtu-update DaemonSet.
+	rolloutNamespace   string
+	rolloutPodSelector string
+
+	// rolloutBatchSize is the number of nodes updated at the same time.
+	rolloutBatchSize int
+
+	// rolloutByZone will cause nodes to be updated one zone at a time
+	// if true.
+	rolloutByZone bool
+
+	// rolloutTimeout is how long to wait for each batch of nodes.
+	rolloutTimeout time.Duration
+
+	// rolloutPollInterval is the interval at which the pods are checked.
+	rolloutPollInterval time.Duration
+
+	// rolloutHealthPort is the port of the health server of the pods,
+	// whose status tells a failed update apart from one in progress. If
+	// zero, only the readiness of the pods is checked.
+	rolloutHealthPort int
+
+	// rolloutRetryFailed will cause nodes which failed in a previous
+	// rollout to be retried if true, rather than halting the rollout.
+	rolloutRetryFailed bool
+)
+
+func init() {
+	flags := controllerCmd.Flags()
+	flags.StringVar(&k8sAPIServer, "k8s-api-server", "",
+		"Address of the Kubernetes API server, eg http://127.0.0.1:8001 for kubectl proxy (default: in-cluster)")
+	flags.StringVar(&rolloutNodeSelector, "node-selector", "",
+		"Label selector of the nodes to update")
+	flags.StringVar(&rolloutNamespace, "pod-namespace", "kube-system",
+		"Namespace of the mtu-update DaemonSet")
+	flags.StringVar(&rolloutPodSelector, "pod-selector", "k8s-app=mtu-update",
+		"Label selector of the mtu-update DaemonSet pods")
+	flags.IntVar(&rolloutBatchSize, "batch-size", 1,
+		"Number of nodes to update at the same time")
+	flags.BoolVar(&rolloutByZone, "by-zone", false,
+		"Update the nodes of one zone at a time")
+	flags.DurationVar(&rolloutTimeout, "timeout", 10*time.Minute,
+		"Time to wait for each batch of nodes to be updated")
+	flags.DurationVar(&rolloutPollInterval, "poll-interval", 5*time.Second,
+		"Interval between checks of the mtu-update pods")
+	flags.IntVar(&rolloutHealthPort, "health-port", 9876,
+		"Port of the --health-address of the mtu-update pods, to read their status through the API server (0 to only check readiness)")
+	flags.BoolVar(&rolloutRetryFailed, "retry-failed", false,
+		"Retry nodes which failed in a previous rollout instead of halting")
+	rootCmd.AddCommand(controllerCmd)
+}
+
+// nodeZone returns the zone of the node, or an empty string if unknown.
+func nodeZone(node *kubeNode) string {
+	if zone, ok := node.Metadata.Labels[zoneLabel]; ok {
+		return zone
+	}
+	return node.Metadata.Labels[zoneLabelDeprecated]
+}
+
+// rolloutBatches splits the nodes into batches of at most 'size' nodes,
+// sorted by name. If 'byZone' is true, each batch only contains nodes of a
+// single zone, and zones are updated in order.
+func rolloutBatches(nodes []kubeNode, size int, byZone bool) [][]kubeNode {
+	sort.Slice(nodes, func(i, j int) bool {
+		if byZone {
+			zi, zj := nodeZone(&nodes[i]), nodeZone(&nodes[j])
+			if zi != zj {
+				return zi < zj
+			}
+		}
+		return nodes[i].Metadata.Name < nodes[j].Metadata.Name
+	})
+
+	batches := [][]kubeNode{}
+	for i := range nodes {
+		last := len(batches) - 1
+		if last < 0 || len(batches[last]) >= size ||
+			(byZone && nodeZone(&batches[last][0]) != nodeZone(&nodes[i])) {
+			batches = append(batches, []kubeNode{})
+			last++
+		}
+		batches[last] = append(batches[last], nodes[i])
+	}
+	return batches
+}
+
+// podStatus returns rolloutDone if the pod is ready, ie the update on its
+// node succeeded, rolloutFailed if the update failed, and rolloutInProgress
+// otherwise. Containers which exited successfully, eg after sleeping, and
+// were restarted are not considered to have failed.
+func podStatus(pod *kubePod) string {
+	for _, cs := range pod.Status.ContainerStatuses {
+		for _, state := range []kubeContainerState{cs.State, cs.LastState} {
+			if state.Terminated != nil && state.Terminated.ExitCode != 0 {
+				return rolloutFailed
+			}
+		}
+	}
+	if pod.Status.Phase == "Failed" {
+		return rolloutFailed
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == "Ready" && cond.Status == "True" {
+			return rolloutDone
+		}
+	}
+	return rolloutInProgress
+}
+
+// podRunStatus returns rolloutFailed if the running pod reports through
+// its status endpoint that the update failed, as it keeps serving the
+// endpoint rather than exiting, and rolloutInProgress otherwise, including
+// when the status cannot be read yet.
+func podRunStatus(c kubeClient, pod *kubePod) string {
+	if rolloutHealthPort == 0 || pod.Status.Phase != "Running" {
+		return rolloutInProgress
+	}
+	scopedLog := log.WithField("pod", pod.Metadata.Name)
+	status, err := c.GetRunStatus(rolloutNamespace, pod.Metadata.Name,
+		rolloutHealthPort)
+	if err != nil {
+		scopedLog.WithError(err).Debug("Failed to read update status")
+		return rolloutInProgress
+	}
+	if status.Phase == phaseFailed {
+		scopedLog.WithField("error", status.LastError).Warn("Pod reports failed update")
+		return rolloutFailed
+	}
+	return rolloutInProgress
+}
+
+// nodeStatus returns the status of the update on the named node, derived
+// from the mtu-update pods scheduled on it.
+func nodeStatus(c kubeClient, name string) (string, error) {
+	pods, err := c.ListPods(rolloutNamespace, rolloutPodSelector, name)
+	if err != nil {
+		return "", err
+	}
+	if len(pods) == 0 {
+		return rolloutInProgress, nil
+	}
+	status := rolloutDone
+	for i := range pods {
+		podState := podStatus(&pods[i])
+		if podState == rolloutInProgress {
+			podState = podRunStatus(c, &pods[i])
+		}
+		switch podState {
+		case rolloutFailed:
+			return rolloutFailed, nil
+		case rolloutInProgress:
+			status = rolloutInProgress
+		}
+	}
+	return status, nil
+}
+
+// setNodeStatus records the status of the update on the named node.
+func setNodeStatus(c kubeClient, name, status string) error {
+	return c.PatchNode(name, nil, map[string]string{
+		rolloutAnnotation: status,
+	})
+}
+
+// rolloutBatch releases the nodes of the batch for updating, and waits until
+// the update has succeeded or failed on each of them, or 'timeout' expires.
+// The outcome is recorded on each node, and nodes which time out are
+// recorded as failed. Returns an error if the update failed or timed out on
+// any node.
+func rolloutBatch(c kubeClient, batch []kubeNode, timeout, interval time.Duration) error {
+	pending := make(map[string]struct{}, len(batch))
+	for i := range batch {
+		name := batch[i].Metadata.Name
+		pending[name] = struct{}{}
+		err := c.PatchNode(name,
+			map[string]string{rolloutLabel: "true"},
+			map[string]string{rolloutAnnotation: rolloutInProgress})
+		if err != nil {
+			return fmt.Errorf("failed to release node %s: %s", name, err)
+		}
+		log.WithField("node", name).Info("Released node for update")
+	}
+
+	failed := []string{}
+	deadline := time.Now().Add(timeout)
+	for len(pending) > 0 {
+		for name := range pending {
+			status, err := nodeStatus(c, name)
+			if err != nil {
+				log.WithError(err).WithField("node", name).Warn(
+					"Failed to get update status")
+				continue
+			}
+			if status == rolloutInProgress {
+				continue
+			}
+			delete(pending, name)
+			if err := setNodeStatus(c, name, status); err != nil {
+				log.WithError(err).WithField("node", name).Warn(
+					"Failed to record update status")
+			}
+			if status == rolloutFailed {
+				log.WithField("node", name).Warn("Update failed")
+				failed = append(failed, name)
+			} else {
+				log.WithField("node", name).Info("Update done")
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			names := make([]string, 0, len(pending))
+			for name := range pending {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				log.WithField("node", name).Warn("Update timed out")
+				if err := setNodeStatus(c, name, rolloutFailed); err != nil {
+					log.WithError(err).WithField("node", name).Warn(
+						"Failed to record update status")
+				}
+			}
+			return fmt.Errorf("timed out waiting for nodes %s",
+				strings.Join(names, ", "))
+		}
+		time.Sleep(interval)
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("update failed on nodes %s",
+			strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// rollout updates the nodes matching the node selector batch by batch,
+// halting at the first batch in which the update fails. Nodes which were
+// updated by a previous rollout are skipped, so an interrupted rollout can
+// be resumed by running it again.
+func rollout(c kubeClient) error {
+	nodes, err := c.ListNodes(rolloutNodeSelector)
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %s", err)
+	}
+
+	batches := rolloutBatches(nodes, rolloutBatchSize, rolloutByZone)
+	for i, batch := range batches {
+		todo := make([]kubeNode, 0, len(batch))
+		for _, node := range batch {
+			switch node.Metadata.Annotations[rolloutAnnotation] {
+			case rolloutDone:
+				log.WithField("node", node.Metadata.Name).Debug(
+					"Node already updated, skipping")
+				continue
+			case rolloutFailed:
+				if !rolloutRetryFailed {
+					return fmt.Errorf("update previously failed on node %s",
+						node.Metadata.Name)
+				}
+			}
+			todo = append(todo, node)
+		}
+		if len(todo) == 0 {
+			continue
+		}
+
+		scopedLog := log.WithFields(logrus.Fields{
+			"batch": fmt.Sprintf("%d/%d", i+1, len(batches)),
+			"nodes": len(todo),
+		})
+		if rolloutByZone {
+			scopedLog = scopedLog.WithField("zone", nodeZone(&todo[0]))
+		}
+		scopedLog.Info("Updating batch")
+		if err := rolloutBatch(c, todo, rolloutTimeout, rolloutPollInterval); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Rollout complete on %d nodes", len(nodes))
+	return nil
+}
+
+func runController(cmd *cobra.Command) {
+	if verbose {
+		log.Level = logrus.DebugLevel
+	}
+	if rolloutBatchSize < 1 {
+		log.Fatalf("Invalid batch size %d", rolloutBatchSize)
+	}
+	if rolloutPollInterval <= 0 {
+		log.Fatalf("Invalid poll interval %s", rolloutPollInterval)
+	}
+
+	c, err := newKubeClient(k8sAPIServer)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create Kubernetes client")
+	}
+	if err := rollout(c); err != nil {
+		log.WithError(err).Fatal("Rollout halted")
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Outcomes of the update on a node of fakeKubeClient, in addition to
+// rolloutDone and rolloutInProgress, which never completes.
+const (
+	// fakeExited is a failed update whose container exited with an
+	// error.
+	fakeExited = "exited"
+	// fakeServing is a failed update whose pod keeps serving its status.
+	fakeServing = "serving"
+)
+
+// fakeKubeClient is an in-memory kubeClient, which schedules an mtu-update
+// pod on each node once it is released by the controller. The pod ends up
+// with the outcome of its node in 'outcomes', or rolloutDone if not listed.
+type fakeKubeClient struct {
+	nodes    map[string]*kubeNode
+	outcomes map[string]string
+
+	// released lists the nodes in the order they were released.
+	released []string
+}
+
+func newFakeKubeClient() *fakeKubeClient {
+	return &fakeKubeClient{
+		nodes:    map[string]*kubeNode{},
+		outcomes: map[string]string{},
+	}
+}
+
+// addNode adds a node in the specified zone, with the annotation recording
+// the status of a previous rollout unless 'status' is empty.
+func (c *fakeKubeClient) addNode(name, zone, status string) {
+	node := &kubeNode{}
+	node.Metadata.Name = name
+	node.Metadata.Labels = map[string]string{}
+	node.Metadata.Annotations = map[string]string{}
+	if zone != "" {
+		node.Metadata.Labels[zoneLabel] = zone
+	}
+	if status != "" {
+		node.Metadata.Annotations[rolloutAnnotation] = status
+	}
+	c.nodes[name] = node
+}
+
+// status returns the status of the rollout recorded on the named node.
+func (c *fakeKubeClient) status(name string) string {
+	return c.nodes[name].Metadata.Annotations[rolloutAnnotation]
+}
+
+func (c *fakeKubeClient) ListNodes(selector string) ([]kubeNode, error) {
+	nodes := make([]kubeNode, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		nodes = append(nodes, *node)
+	}
+	return nodes, nil
+}
+
+func (c *fakeKubeClient) GetNode(name string) (*kubeNode, error) {
+	node, ok := c.nodes[name]
+	if !ok {
+		return nil, fmt.Errorf("node %s not found", name)
+	}
+	return node, nil
+}
+
+func (c *fakeKubeClient) PatchNode(name string, labels, annotations map[string]string) error {
+	node, ok := c.nodes[name]
+	if !ok {
+		return fmt.Errorf("node %s not found", name)
+	}
+	if labels[rolloutLabel] == "true" && node.Metadata.Labels[rolloutLabel] != "true" {
+		c.released = append(c.released, name)
+	}
+	for k, v := range labels {
+		node.Metadata.Labels[k] = v
+	}
+	for k, v := range annotations {
+		node.Metadata.Annotations[k] = v
+	}
+	return nil
+}
+
+func (c *fakeKubeClient) ListPods(namespace, selector, nodeName string) ([]kubePod, error) {
+	node, ok := c.nodes[nodeName]
+	if !ok || node.Metadata.Labels[rolloutLabel] != "true" {
+		return nil, nil
+	}
+
+	pod := kubePod{}
+	pod.Metadata.Name = "mtu-update-" + nodeName
+	pod.Spec.NodeName = nodeName
+	pod.Status.Phase = "Running"
+	pod.Status.ContainerStatuses = make([]struct {
+		State     kubeContainerState `json:"state"`
+		LastState kubeContainerState `json:"lastState"`
+	}, 1)
+	switch c.outcomes[nodeName] {
+	case "", rolloutDone:
+		pod.Status.Conditions = append(pod.Status.Conditions, struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		}{Type: "Ready", Status: "True"})
+	case fakeExited:
+		pod.Status.ContainerStatuses[0].LastState.Terminated = &struct {
+			ExitCode int `json:"exitCode"`
+		}{ExitCode: 1}
+	}
+	return []kubePod{pod}, nil
+}
+
+func (c *fakeKubeClient) GetRunStatus(namespace, name string, port int) (*runStatus, error) {
+	status := newRunStatus()
+	switch c.outcomes[strings.TrimPrefix(name, "mtu-update-")] {
+	case fakeServing:
+		status.fail(fmt.Errorf("1 operations failed"), "MTU update partially failed")
+	case rolloutInProgress:
+		status.setPhase(phaseUpdating)
+	default:
+		status.setPhase(phaseDone)
+	}
+	return status, nil
+}
+
+// setRolloutFlags sets the controller flags with short timeouts, and returns
+// a function restoring them.
+func setRolloutFlags(batchSize int, byZone, retryFailed bool) func() {
+	savedSize, savedByZone, savedRetry := rolloutBatchSize, rolloutByZone, rolloutRetryFailed
+	savedTimeout, savedInterval := rolloutTimeout, rolloutPollInterval
+	rolloutBatchSize, rolloutByZone, rolloutRetryFailed = batchSize, byZone, retryFailed
+	rolloutTimeout, rolloutPollInterval = 100*time.Millisecond, time.Millisecond
+	return func() {
+		rolloutBatchSize, rolloutByZone, rolloutRetryFailed = savedSize, savedByZone, savedRetry
+		rolloutTimeout, rolloutPollInterval = savedTimeout, savedInterval
+	}
+}
+
+func TestRolloutBatches(t *testing.T) {
+	c := newFakeKubeClient()
+	c.addNode("d", "zone-b", "")
+	c.addNode("a", "zone-a", "")
+	c.addNode("c", "zone-b", "")
+	c.addNode("b", "zone-a", "")
+	c.addNode("e", "zone-a", "")
+
+	tests := []struct {
+		size    int
+		byZone  bool
+		batches [][]string
+	}{
+		{size: 1, batches: [][]string{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}}},
+		{size: 2, batches: [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{size: 2, byZone: true, batches: [][]string{{"a", "b"}, {"e"}, {"c", "d"}}},
+		{size: 10, byZone: true, batches: [][]string{{"a", "b", "e"}, {"c", "d"}}},
+	}
+	for _, tt := range tests {
+		nodes, _ := c.ListNodes("")
+		names := [][]string{}
+		for _, batch := range rolloutBatches(nodes, tt.size, tt.byZone) {
+			batchNames := []string{}
+			for _, node := range batch {
+				batchNames = append(batchNames, node.Metadata.Name)
+			}
+			names = append(names, batchNames)
+		}
+		if !reflect.DeepEqual(names, tt.batches) {
+			t.Errorf("batches of size %d by zone %v are %v, expected %v",
+				tt.size, tt.byZone, names, tt.batches)
+		}
+	}
+}
+
+func TestRolloutByZone(t *testing.T) {
+	defer setRolloutFlags(10, true, false)()
+	c := newFakeKubeClient()
+	c.addNode("a", "zone-b", "")
+	c.addNode("b", "zone-a", "")
+	c.addNode("c", "zone-b", "")
+
+	if err := rollout(c); err != nil {
+		t.Fatalf("rollout failed: %s", err)
+	}
+	if expected := []string{"b", "a", "c"}; !reflect.DeepEqual(c.released, expected) {
+		t.Errorf("released %v, expected %v", c.released, expected)
+	}
+	for name := range c.nodes {
+		if status := c.status(name); status != rolloutDone {
+			t.Errorf("node %s has status %q, expected %q", name, status, rolloutDone)
+		}
+	}
+}
+
+func TestRolloutHaltsOnFailure(t *testing.T) {
+	for _, outcome := range []string{fakeExited, fakeServing, rolloutInProgress} {
+		t.Run(outcome, func(t *testing.T) {
+			defer setRolloutFlags(1, false, false)()
+			c := newFakeKubeClient()
+			c.addNode("a", "", "")
+			c.addNode("b", "", "")
+			c.addNode("c", "", "")
+			c.outcomes["b"] = outcome
+
+			if err := rollout(c); err == nil {
+				t.Fatal("rollout succeeded, expected it to halt")
+			}
+			if expected := []string{"a", "b"}; !reflect.DeepEqual(c.released, expected) {
+				t.Errorf("released %v, expected %v", c.released, expected)
+			}
+			expected := map[string]string{"a": rolloutDone, "b": rolloutFailed, "c": ""}
+			for name, status := range expected {
+				if c.status(name) != status {
+					t.Errorf("node %s has status %q, expected %q", name,
+						c.status(name), status)
+				}
+			}
+		})
+	}
+}
+
+func TestRolloutResumes(t *testing.T) {
+	defer setRolloutFlags(1, false, false)()
+	c := newFakeKubeClient()
+	c.addNode("a", "", rolloutDone)
+	c.addNode("b", "", rolloutInProgress)
+	c.addNode("c", "", "")
+
+	if err := rollout(c); err != nil {
+		t.Fatalf("rollout failed: %s", err)
+	}
+	if expected := []string{"b", "c"}; !reflect.DeepEqual(c.released, expected) {
+		t.Errorf("released %v, expected %v", c.released, expected)
+	}
+}
+
+func TestRolloutPreviouslyFailed(t *testing.T) {
+	defer setRolloutFlags(1, false, false)()
+	c := newFakeKubeClient()
+	c.addNode("a", "", rolloutDone)
+	c.addNode("b", "", rolloutFailed)
+	c.addNode("c", "", "")
+
+	if err := rollout(c); err == nil {
+		t.Fatal("rollout succeeded, expected it to halt at the failed node")
+	}
+	if len(c.released) != 0 {
+		t.Errorf("released %v, expected none", c.released)
+	}
+
+	rolloutRetryFailed = true
+	if err := rollout(c); err != nil {
+		t.Fatalf("rollout with retry failed: %s", err)
+	}
+	if expected := []string{"b", "c"}; !reflect.DeepEqual(c.released, expected) {
+		t.Errorf("released %v, expected %v", c.released, expected)
+	}
+}
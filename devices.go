@@ -0,0 +1,142 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ruleDevice devices are set to the device MTU.
+	ruleDevice = "device"
+	// ruleTunnel devices carry the inner packets of the tunnel, so are
+	// set to the tunnel MTU.
+	ruleTunnel = "tunnel"
+	// ruleSkip devices are left alone.
+	ruleSkip = "skip"
+	// ruleFixed devices are set to a fixed MTU.
+	ruleFixed = "fixed"
+
+	// ciliumDevicePrefix is the prefix of the names of all devices
+	// created by Cilium in the host namespace.
+	ciliumDevicePrefix = "cilium"
+)
+
+// deviceRule describes how the MTU of a Cilium device in the host namespace
+// is determined.
+type deviceRule struct {
+	kind string
+
+	// mtu is the MTU of ruleFixed devices.
+	mtu int
+}
+
+var (
+	// defaultDeviceRules are the rules for the devices created by Cilium.
+	// cilium_host and cilium_net are a veth pair connecting the host
+	// stack to the datapath, while the tunnel devices encapsulate pod
+	// traffic to other nodes.
+	defaultDeviceRules = map[string]deviceRule{
+		"cilium_host":   {kind: ruleDevice},
+		"cilium_net":    {kind: ruleDevice},
+		"cilium_vxlan":  {kind: ruleTunnel},
+		"cilium_geneve": {kind: ruleTunnel},
+	}
+
+	// deviceRuleOverrides are the rules configured by the user, which
+	// take precedence over defaultDeviceRules.
+	deviceRuleOverrides = map[string]deviceRule{}
+)
+
+func (r deviceRule) String() string {
+	if r.kind == ruleFixed {
+		return strconv.Itoa(r.mtu)
+	}
+	return r.kind
+}
+
+// targetMTU returns the MTU which the rule configures on the device.
+func (r deviceRule) targetMTU(deviceMTU, tunnelMTU int) int {
+	switch r.kind {
+	case ruleTunnel:
+		return tunnelMTU
+	case ruleFixed:
+		return r.mtu
+	}
+	return deviceMTU
+}
+
+// parseDeviceRules parses rules of the form <device>=<rule>, where the rule
+// is either ruleDevice, ruleTunnel, ruleSkip or an MTU.
+func parseDeviceRules(specs []string) (map[string]deviceRule, error) {
+	rules := make(map[string]deviceRule, len(specs))
+	for _, spec := range specs {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid device rule %q", spec)
+		}
+		switch kv[1] {
+		case ruleDevice, ruleTunnel, ruleSkip:
+			rules[kv[0]] = deviceRule{kind: kv[1]}
+		default:
+			mtu, err := strconv.Atoi(kv[1])
+			if err != nil || mtu < 68 {
+				return nil, fmt.Errorf("invalid rule %q for device %s",
+					kv[1], kv[0])
+			}
+			rules[kv[0]] = deviceRule{kind: ruleFixed, mtu: mtu}
+		}
+	}
+	return rules, nil
+}
+
+// validateDeviceRules checks that the MTU of each rule configuring a fixed
+// MTU is valid for the specified families.
+func validateDeviceRules(families []string) error {
+	names := make([]string, 0, len(deviceRuleOverrides))
+	for name, rule := range deviceRuleOverrides {
+		if rule.kind == ruleFixed {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		what := fmt.Sprintf("rule for device %s: MTU", name)
+		if err := validateMTU(what, deviceRuleOverrides[name].mtu, families); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupDeviceRule returns the rule for the host device with the specified
+// name, and whether the device is managed by a rule. Devices with an
+// override are always managed. Other devices created by Cilium which have
+// no specific rule are set to the device MTU.
+func lookupDeviceRule(name string) (deviceRule, bool) {
+	if rule, ok := deviceRuleOverrides[name]; ok {
+		return rule, true
+	}
+	if rule, ok := defaultDeviceRules[name]; ok {
+		return rule, true
+	}
+	if strings.HasPrefix(name, ciliumDevicePrefix) {
+		return deviceRule{kind: ruleDevice}, true
+	}
+	return deviceRule{}, false
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDeviceRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs []string
+		rules map[string]deviceRule
+	}{
+		{name: "none", rules: map[string]deviceRule{}},
+		{name: "kinds", specs: []string{"cilium_host=tunnel", "cilium_vxlan=device", "cilium_net=skip"},
+			rules: map[string]deviceRule{
+				"cilium_host":  {kind: ruleTunnel},
+				"cilium_vxlan": {kind: ruleDevice},
+				"cilium_net":   {kind: ruleSkip},
+			}},
+		{name: "fixed", specs: []string{"cilium_wg0=1420"},
+			rules: map[string]deviceRule{"cilium_wg0": {kind: ruleFixed, mtu: 1420}}},
+		{name: "last rule wins", specs: []string{"cilium_host=skip", "cilium_host=9000"},
+			rules: map[string]deviceRule{"cilium_host": {kind: ruleFixed, mtu: 9000}}},
+		{name: "missing rule", specs: []string{"cilium_host"}},
+		{name: "missing device", specs: []string{"=tunnel"}},
+		{name: "unknown rule", specs: []string{"cilium_host=auto"}},
+		{name: "fixed below minimum", specs: []string{"cilium_host=67"}},
+		{name: "one invalid", specs: []string{"cilium_host=skip", "cilium_net=-1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseDeviceRules(tt.specs)
+			if tt.rules == nil {
+				if err == nil {
+					t.Fatalf("parsed rules %v, expected an error", rules)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse rules: %s", err)
+			}
+			if !reflect.DeepEqual(rules, tt.rules) {
+				t.Errorf("parsed rules %v, expected %v", rules, tt.rules)
+			}
+		})
+	}
+}
+
+func TestValidateDeviceRules(t *testing.T) {
+	savedOverrides := deviceRuleOverrides
+	defer func() {
+		deviceRuleOverrides = savedOverrides
+	}()
+
+	tests := []struct {
+		name      string
+		overrides map[string]deviceRule
+		families  []string
+		valid     bool
+	}{
+		{name: "none", families: []string{familyIPv4, familyIPv6}, valid: true},
+		{name: "fixed ipv4", families: []string{familyIPv4}, valid: true,
+			overrides: map[string]deviceRule{"cilium_host": {kind: ruleFixed, mtu: 1000}}},
+		{name: "fixed below ipv6 minimum", families: []string{familyIPv4, familyIPv6},
+			overrides: map[string]deviceRule{"cilium_host": {kind: ruleFixed, mtu: 1000}}},
+		{name: "fixed above maximum", families: []string{familyIPv4},
+			overrides: map[string]deviceRule{"cilium_host": {kind: ruleFixed, mtu: 65521}}},
+		{name: "other kinds ignored", families: []string{familyIPv6}, valid: true,
+			overrides: map[string]deviceRule{
+				"cilium_host": {kind: ruleTunnel},
+				"cilium_net":  {kind: ruleSkip},
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deviceRuleOverrides = tt.overrides
+			err := validateDeviceRules(tt.families)
+			if tt.valid && err != nil {
+				t.Errorf("rules %v rejected: %s", tt.overrides, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("rules %v accepted, expected an error", tt.overrides)
+			}
+		})
+	}
+}
+
+func TestLookupDeviceRule(t *testing.T) {
+	savedOverrides := deviceRuleOverrides
+	defer func() {
+		deviceRuleOverrides = savedOverrides
+	}()
+	deviceRuleOverrides = map[string]deviceRule{
+		"cilium_wg0": {kind: ruleFixed, mtu: 1400},
+		"eth1":       {kind: ruleSkip},
+	}
+
+	const deviceMTU, tunnelMTU = 1500, 1450
+	tests := []struct {
+		name    string
+		managed bool
+		rule    deviceRule
+		mtu     int
+	}{
+		{name: "cilium_host", managed: true, rule: deviceRule{kind: ruleDevice}, mtu: deviceMTU},
+		{name: "cilium_net", managed: true, rule: deviceRule{kind: ruleDevice}, mtu: deviceMTU},
+		{name: "cilium_geneve", managed: true, rule: deviceRule{kind: ruleTunnel}, mtu: tunnelMTU},
+		{name: "cilium_vxlan", managed: true, rule: deviceRule{kind: ruleTunnel}, mtu: tunnelMTU},
+		{name: "cilium_wg0", managed: true, rule: deviceRule{kind: ruleFixed, mtu: 1400}, mtu: 1400},
+		{name: "cilium_ipip", managed: true, rule: deviceRule{kind: ruleDevice}, mtu: deviceMTU},
+		{name: "eth1", managed: true, rule: deviceRule{kind: ruleSkip}, mtu: deviceMTU},
+		{name: "eth0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, managed := lookupDeviceRule(tt.name)
+			if managed != tt.managed {
+				t.Fatalf("device managed is %t, expected %t", managed, tt.managed)
+			}
+			if !managed {
+				return
+			}
+			if rule != tt.rule {
+				t.Errorf("rule is %s, expected %s", rule, tt.rule)
+			}
+			if mtu := rule.targetMTU(deviceMTU, tunnelMTU); mtu != tt.mtu {
+				t.Errorf("target MTU is %d, expected %d", mtu, tt.mtu)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	sourceProc      = "proc"
+	sourceFD        = "fd"
+	sourceBindMount = "bind"
+
+	// nsfsMagic is the filesystem type of namespace files.
+	nsfsMagic = 0x6e736673
+
+	// netnsLinkPrefix is the prefix of the target of a symbolic link to
+	// a network namespace in /proc, eg "net:[4026531993]".
+	netnsLinkPrefix = "net:["
+)
+
+var (
+	// defaultNetnsDirs are the directories in which network namespaces
+	// are commonly bind-mounted by iproute2, CNI plugins, containerd,
+	// CRI-O and Docker.
+	defaultNetnsDirs = []string{
+		"/var/run/netns",
+		"/run/docker/netns",
+	}
+)
+
+// nsRef is a path through which a network namespace can be opened.
+type nsRef struct {
+	path string
+
+	// source describes how the namespace was found, either the name of
+	// the discovery source or the path of a bind mount.
+	source string
+
+	// pid is the process running in the namespace, or 0 if the
+	// namespace is merely referenced.
+	pid int
+}
+
+// nsSource finds paths through which network namespaces can be opened.
+// References to the same namespace may be returned several times, and are
+// deduplicated by inode by the caller.
+type nsSource interface {
+	// Name returns the name of the source for logging.
+	Name() string
+
+	// Scan returns the references to the namespaces found.
+	Scan() ([]nsRef, error)
+}
+
+// procSource finds the namespaces of running processes.
+type procSource struct{}
+
+func (procSource) Name() string {
+	return sourceProc
+}
+
+func (procSource) Scan() ([]nsRef, error) {
+	paths, err := filepath.Glob("/proc/*/ns/net")
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]nsRef, 0, len(paths))
+	for _, path := range paths {
+		refs = append(refs, nsRef{
+			path:   path,
+			source: sourceProc,
+			pid:    pidFromPath(path),
+		})
+	}
+	return refs, nil
+}
+
+// fdSource finds namespaces held open through file descriptors by
+// processes which do not necessarily run in them, eg container runtimes.
+type fdSource struct{}
+
+func (fdSource) Name() string {
+	return sourceFD
+}
+
+func (fdSource) Scan() ([]nsRef, error) {
+	paths, err := filepath.Glob("/proc/*/fd/*")
+	if err != nil {
+		return nil, err
+	}
+
+	// Many descriptors may refer to the same namespace, so only return
+	// the first reference to each one.
+	seen := make(map[string]struct{})
+	refs := []nsRef{}
+	for _, path := range paths {
+		target, err := os.Readlink(path)
+		if err != nil || !strings.HasPrefix(target, netnsLinkPrefix) {
+			continue
+		}
+		if _, ok := seen[target]; ok {
+			continue
+		}
+		seen[target] = struct{}{}
+		refs = append(refs, nsRef{
+			path:   path,
+			source: sourceFD,
+		})
+	}
+	return refs, nil
+}
+
+// bindMountSource finds namespaces bind-mounted onto files in a directory.
+type bindMountSource struct {
+	dir string
+}
+
+func (s bindMountSource) Name() string {
+	return fmt.Sprintf("%s:%s", sourceBindMount, s.dir)
+}
+
+func (s bindMountSource) Scan() ([]nsRef, error) {
+	refs := []nsRef{}
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The directory only exists with some runtimes.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			refs = append(refs, nsRef{
+				path:   path,
+				source: path,
+			})
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// newNSSources returns the namespace discovery sources with the specified
+// names. Bind mounts are searched for in each of 'dirs'.
+func newNSSources(names, dirs []string) ([]nsSource, error) {
+	sources := []nsSource{}
+	for _, name := range names {
+		switch name {
+		case sourceProc:
+			sources = append(sources, procSource{})
+		case sourceFD:
+			sources = append(sources, fdSource{})
+		case sourceBindMount:
+			for _, dir := range dirs {
+				sources = append(sources, bindMountSource{dir: dir})
+			}
+		default:
+			return nil, fmt.Errorf("unknown netns source %q", name)
+		}
+	}
+	return sources, nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	encapNone      = "none"
+	encapVXLAN     = "vxlan"
+	encapGeneve    = "geneve"
+	encapIPIP      = "ipip"
+	encapGRE       = "gre"
+	encapWireGuard = "wireguard"
+	encapIPsec     = "ipsec"
+
+	// encapSeparator separates encapsulations which are stacked, eg a
+	// tunnel protocol and encryption.
+	encapSeparator = "+"
+
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+	familyDual = "dual"
+	// familyAuto selects the pod address families enabled in Cilium.
+	familyAuto = "auto"
+
+	udpHeaderLen       = 8
+	vxlanHeaderLen     = 8
+	geneveHeaderLen    = 8
+	greHeaderLen       = 4
+	wireguardHeaderLen = 16
+	wireguardTagLen    = 16
+	espHeaderLen       = 8
+	espTrailerLen      = 2
+	ethernetHeaderLen  = 14
+
+	// maxGeneveOptionLen is the maximum length of Geneve options, which
+	// is expressed in 4 byte multiples in a 6 bit field.
+	maxGeneveOptionLen = 63 * 4
+)
+
+// espCipher describes the per-packet overhead of an ESP cipher suite.
+type espCipher struct {
+	ivLen     int
+	blockSize int
+	icvLen    int
+}
+
+var (
+	espCiphers = map[string]espCipher{
+		"aes-gcm":           {ivLen: 8, blockSize: 4, icvLen: 16},
+		"chacha20-poly1305": {ivLen: 8, blockSize: 4, icvLen: 16},
+		"aes-cbc-sha256":    {ivLen: 16, blockSize: 16, icvLen: 16},
+		"aes-cbc-sha1":      {ivLen: 16, blockSize: 16, icvLen: 12},
+	}
+)
+
+// ipHeaderLen returns the length of the outer IP header for the family.
+func ipHeaderLen(family string) int {
+	if family == familyIPv6 {
+		return ipv6HeaderLen
+	}
+	return ipv4HeaderLen
+}
+
+// ipFamily returns the address family of the IP address.
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return familyIPv4
+	}
+	return familyIPv6
+}
+
+// familyEnabled returns true if pod addresses and routes of the specified
+// family are to be updated.
+func familyEnabled(family string) bool {
+	return podFamily == familyDual || podFamily == family
+}
+
+// netlinkFamily returns the netlink address family covering the enabled pod
+// address families.
+func netlinkFamily() int {
+	switch podFamily {
+	case familyIPv4:
+		return netlink.FAMILY_V4
+	case familyIPv6:
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_ALL
+}
+
+// familyNetlink returns the netlink address family of the family.
+func familyNetlink(family string) int {
+	if family == familyIPv6 {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+// underlayFamilies returns the families used by the underlay network for
+// the specified setting.
+func underlayFamilies(underlay string) ([]string, error) {
+	switch underlay {
+	case familyIPv4, familyIPv6:
+		return []string{underlay}, nil
+	case familyDual:
+		return []string{familyIPv4, familyIPv6}, nil
+	}
+	return nil, fmt.Errorf("invalid underlay family %q", underlay)
+}
+
+// encapOverhead returns the number of bytes added to each packet by the
+// encapsulation when the underlay uses the specified family. The outer
+// Ethernet header is not accounted against the MTU, but the inner Ethernet
+// header of L2 tunnels is.
+func encapOverhead(encap, family string) (int, error) {
+	ipLen := ipHeaderLen(family)
+	switch encap {
+	case encapNone:
+		return 0, nil
+	case encapVXLAN:
+		return ipLen + udpHeaderLen + vxlanHeaderLen + ethernetHeaderLen, nil
+	case encapGeneve:
+		if geneveOptionLen < 0 || geneveOptionLen > maxGeneveOptionLen ||
+			geneveOptionLen%4 != 0 {
+			return 0, fmt.Errorf("invalid Geneve option length %d",
+				geneveOptionLen)
+		}
+		return ipLen + udpHeaderLen + geneveHeaderLen + geneveOptionLen +
+			ethernetHeaderLen, nil
+	case encapIPIP:
+		return ipLen, nil
+	case encapGRE:
+		return ipLen + greHeaderLen, nil
+	case encapWireGuard:
+		return ipLen + udpHeaderLen + wireguardHeaderLen + wireguardTagLen, nil
+	case encapIPsec:
+		cipher, ok := espCiphers[ipsecCipher]
+		if !ok {
+			return 0, fmt.Errorf("unknown IPsec cipher %q", ipsecCipher)
+		}
+		// Assume the worst case for padding up to the block size.
+		return ipLen + espHeaderLen + cipher.ivLen + cipher.blockSize - 1 +
+			espTrailerLen + cipher.icvLen, nil
+	}
+	return 0, fmt.Errorf("unknown encapsulation %q", encap)
+}
+
+// resolveTunnelOverheads returns the tunnel overhead for each underlay
+// family. If 'explicit' is true, the tunnel overhead configured by the user
+// is used for all families; otherwise it is computed from the encapsulation,
+// summing the overheads of stacked encapsulations.
+func resolveTunnelOverheads(explicit bool) (map[string]int, error) {
+	families, err := underlayFamilies(underlayFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	overheads := make(map[string]int, len(families))
+	for _, family := range families {
+		if explicit {
+			// Maximum Geneve tunnel overhead is 310B
+			// (draft-ietf-nvo3-geneve-06).
+			if tunnelOverhead < 0 || tunnelOverhead > 310 {
+				return nil, fmt.Errorf("invalid tunnel overhead %d",
+					tunnelOverhead)
+			}
+			overheads[family] = tunnelOverhead
+			continue
+		}
+		for _, encap := range strings.Split(encapsulation, encapSeparator) {
+			overhead, err := encapOverhead(encap, family)
+			if err != nil {
+				return nil, err
+			}
+			overheads[family] += overhead
+		}
+	}
+
+	return overheads, nil
+}
+
+// sortedFamilies returns the families of the map in a stable order.
+func sortedFamilies(m map[string]int) []string {
+	families := make([]string, 0, len(m))
+	for family := range m {
+		families = append(families, family)
+	}
+	sort.Strings(families)
+	return families
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncapOverhead(t *testing.T) {
+	savedOptionLen, savedCipher := geneveOptionLen, ipsecCipher
+	defer func() {
+		geneveOptionLen, ipsecCipher = savedOptionLen, savedCipher
+	}()
+
+	tests := []struct {
+		name      string
+		encap     string
+		optionLen int
+		cipher    string
+		ipv4      int
+		ipv6      int
+		invalid   bool
+	}{
+		{name: "none", encap: encapNone},
+		{name: "vxlan", encap: encapVXLAN, ipv4: 50, ipv6: 70},
+		{name: "geneve", encap: encapGeneve, ipv4: 50, ipv6: 70},
+		{name: "geneve with options", encap: encapGeneve, optionLen: 8, ipv4: 58, ipv6: 78},
+		{name: "geneve with unaligned options", encap: encapGeneve, optionLen: 6, invalid: true},
+		{name: "geneve with oversized options", encap: encapGeneve, optionLen: 256, invalid: true},
+		{name: "ipip", encap: encapIPIP, ipv4: 20, ipv6: 40},
+		{name: "gre", encap: encapGRE, ipv4: 24, ipv6: 44},
+		{name: "wireguard", encap: encapWireGuard, ipv4: 60, ipv6: 80},
+		{name: "ipsec", encap: encapIPsec, cipher: "aes-gcm", ipv4: 57, ipv6: 77},
+		{name: "ipsec cbc", encap: encapIPsec, cipher: "aes-cbc-sha256", ipv4: 77, ipv6: 97},
+		{name: "ipsec unknown cipher", encap: encapIPsec, cipher: "des", invalid: true},
+		{name: "unknown", encap: "stt", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			geneveOptionLen, ipsecCipher = tt.optionLen, tt.cipher
+			for family, expected := range map[string]int{familyIPv4: tt.ipv4, familyIPv6: tt.ipv6} {
+				overhead, err := encapOverhead(tt.encap, family)
+				if tt.invalid {
+					if err == nil {
+						t.Errorf("overhead over %s is %d, expected an error", family, overhead)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("failed to compute overhead over %s: %s", family, err)
+					continue
+				}
+				if overhead != expected {
+					t.Errorf("overhead over %s is %d, expected %d", family, overhead, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveTunnelOverheads(t *testing.T) {
+	savedEncap, savedUnderlay, savedOverhead := encapsulation, underlayFamily, tunnelOverhead
+	savedOptionLen, savedCipher := geneveOptionLen, ipsecCipher
+	defer func() {
+		encapsulation, underlayFamily, tunnelOverhead = savedEncap, savedUnderlay, savedOverhead
+		geneveOptionLen, ipsecCipher = savedOptionLen, savedCipher
+	}()
+	geneveOptionLen, ipsecCipher = 0, "aes-gcm"
+
+	tests := []struct {
+		name      string
+		encap     string
+		underlay  string
+		explicit  bool
+		overhead  int
+		overheads map[string]int
+	}{
+		{name: "vxlan", encap: encapVXLAN, underlay: familyIPv4,
+			overheads: map[string]int{familyIPv4: 50}},
+		{name: "vxlan over dual stack", encap: encapVXLAN, underlay: familyDual,
+			overheads: map[string]int{familyIPv4: 50, familyIPv6: 70}},
+		{name: "geneve over ipv6", encap: encapGeneve, underlay: familyIPv6,
+			overheads: map[string]int{familyIPv6: 70}},
+		{name: "vxlan with ipsec", encap: encapVXLAN + encapSeparator + encapIPsec,
+			underlay: familyDual, overheads: map[string]int{familyIPv4: 107, familyIPv6: 147}},
+		{name: "none", encap: encapNone, underlay: familyDual,
+			overheads: map[string]int{familyIPv4: 0, familyIPv6: 0}},
+		{name: "explicit overhead", encap: encapVXLAN, underlay: familyDual,
+			explicit: true, overhead: 100,
+			overheads: map[string]int{familyIPv4: 100, familyIPv6: 100}},
+		{name: "explicit overhead too large", encap: encapVXLAN, underlay: familyIPv4,
+			explicit: true, overhead: 400},
+		{name: "unknown stacked encapsulation", encap: encapVXLAN + encapSeparator + "stt",
+			underlay: familyIPv4},
+		{name: "invalid underlay", encap: encapVXLAN, underlay: familyAuto},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encapsulation, underlayFamily, tunnelOverhead = tt.encap, tt.underlay, tt.overhead
+			overheads, err := resolveTunnelOverheads(tt.explicit)
+			if tt.overheads == nil {
+				if err == nil {
+					t.Fatalf("resolved overheads %v, expected an error", overheads)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to resolve overheads: %s", err)
+			}
+			if !reflect.DeepEqual(overheads, tt.overheads) {
+				t.Errorf("overheads are %v, expected %v", overheads, tt.overheads)
+			}
+		})
+	}
+}
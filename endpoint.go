@@ -15,7 +15,9 @@
 package main
 
 import (
+	"fmt"
 	"net"
+	"sort"
 
 	"github.com/cilium/cilium/api/v1/models"
 	clientPkg "github.com/cilium/cilium/pkg/client"
@@ -24,33 +26,49 @@ import (
 // endpointInfo caches endpoint information from Cilium which will be useful
 // for updating the MTU of connected endpoints.
 type endpointInfo struct {
-	addrs map[string]struct{}
-	links map[string]struct{}
+	// addrs and links map the addresses and the host side interface
+	// names of endpoints to the endpoint ID.
+	addrs map[string]int64
+	links map[string]int64
+
+	// localCIDRs are the CIDRs from which the local node allocates
+	// endpoint addresses.
+	localCIDRs []*net.IPNet
+
+	// remoteTargets are addresses on other nodes of the cluster, which
+	// are probed to verify the path MTU across the network.
+	remoteTargets []net.IP
 }
 
-// managedIP returns true if the specified IP is a managed IP address.
-func (e *endpointInfo) managedIP(ip net.IP) bool {
-	_, ok := e.addrs[ip.String()]
-	return ok
+// lookupIP returns the ID of the endpoint with the specified IP address, and
+// whether such an endpoint was found.
+func (e *endpointInfo) lookupIP(ip net.IP) (int64, bool) {
+	id, ok := e.addrs[ip.String()]
+	return id, ok
 }
 
-// addIP attempts to insert the specified address into the endpoint info
-// structure. If the specified address is a valid IPv4 or IPv6 address, inserts
-// it and returns true. Otherwise, returns false.
-func (e *endpointInfo) addIP(addr string) bool {
+// addIP attempts to insert the specified address of endpoint 'id' into the
+// endpoint info structure. If the specified address is a valid IPv4 or IPv6
+// address, inserts it and returns true. Empty addresses, ie of a family that
+// is not enabled for the endpoint, are ignored and also return true.
+// Otherwise, returns false.
+func (e *endpointInfo) addIP(id int64, addr string) bool {
+	if addr == "" {
+		return true
+	}
 	ip := net.ParseIP(addr)
 	if ip != nil {
-		e.addrs[addr] = struct{}{}
+		e.addrs[ip.String()] = id
 		return true
 	}
 	return false
 }
 
-// managedLink returns true if the link with the specified name is managed by
-// Cilium.
-func (e *endpointInfo) managedLink(name string) bool {
-	_, ok := e.links[name]
-	return ok
+// lookupLink returns the ID of the endpoint whose interface in the host
+// namespace has the specified name, and whether such an endpoint was found.
+func (e *endpointInfo) lookupLink(name string) (int64, bool) {
+	id, ok := e.links[name]
+	return id, ok
 }
 
 // endpointInvalid returns true if the information we need from the provided
@@ -65,8 +83,8 @@ func endpointInvalid(ep *models.Endpoint) bool {
 // specified endpoint models. Logs errors if any endpoinst are invalid.
 func newEndpointInfoFromEndpoints(eps []*models.Endpoint) *endpointInfo {
 	result := &endpointInfo{
-		addrs: make(map[string]struct{}, len(eps)),
-		links: make(map[string]struct{}, len(eps)),
+		addrs: make(map[string]int64, len(eps)),
+		links: make(map[string]int64, len(eps)),
 	}
 	for _, ep := range eps {
 		if endpointInvalid(ep) {
@@ -75,21 +93,137 @@ func newEndpointInfoFromEndpoints(eps []*models.Endpoint) *endpointInfo {
 		}
 		netConfig := ep.Status.Networking
 		for _, addr := range netConfig.Addressing {
-			if !result.addIP(addr.IPV4) {
+			if addr == nil {
+				continue
+			}
+			if !result.addIP(ep.ID, addr.IPV4) {
 				log.Warnf("Skipping invalid IP %s", addr.IPV4)
 			}
-			if !result.addIP(addr.IPV6) {
+			if !result.addIP(ep.ID, addr.IPV6) {
 				log.Warnf("Skipping invalid IP %s", addr.IPV6)
 			}
 		}
-		result.links[netConfig.InterfaceName] = struct{}{}
+		result.links[netConfig.InterfaceName] = ep.ID
 	}
 
 	return result
 }
 
-// endpoints fetches information about endpoints from Cilium. Returns an error
-// if Cilium cannot be reached or listing the endpoints fails for any reason.
+// addAllocRange parses the allocation range of the node addressing element,
+// and adds it to the local CIDRs.
+func (e *endpointInfo) addAllocRange(addressing *models.NodeAddressingElement) {
+	if addressing == nil || !addressing.Enabled || addressing.AllocRange == "" {
+		return
+	}
+	_, cidr, err := net.ParseCIDR(addressing.AllocRange)
+	if err != nil {
+		log.Warnf("Skipping invalid allocation range %s",
+			addressing.AllocRange)
+		return
+	}
+	e.localCIDRs = append(e.localCIDRs, cidr)
+}
+
+// nodeAddress returns the address of the specified family in 'addressing',
+// or nil if there is none.
+func nodeAddress(addressing *models.NodeAddressing, family string) net.IP {
+	if addressing == nil {
+		return nil
+	}
+	element := addressing.IPV4
+	if family == familyIPv6 {
+		element = addressing.IPV6
+	}
+	if element == nil || element.IP == "" {
+		return nil
+	}
+	return net.ParseIP(element.IP)
+}
+
+// addRemoteTargets picks an address on another node than the local one for
+// each enabled pod family, out of the nodes in the cluster status. The
+// health endpoint of the node is preferred, as it is a pod reached through
+// the same path as other remote pods, over the address of the node itself.
+// Nodes are considered in the order of their names, so that the same nodes
+// are probed from every namespace.
+func (e *endpointInfo) addRemoteTargets(cluster *models.ClusterStatus) {
+	if cluster == nil {
+		return
+	}
+	nodes := make([]*models.NodeElement, 0, len(cluster.Nodes))
+	for _, node := range cluster.Nodes {
+		if node != nil && node.Name != cluster.Self {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		if !familyEnabled(family) {
+			continue
+		}
+		var target net.IP
+		for _, node := range nodes {
+			target = nodeAddress(node.HealthEndpointAddress, family)
+			if target == nil {
+				target = nodeAddress(node.PrimaryAddress, family)
+			}
+			if target != nil {
+				break
+			}
+		}
+		if target != nil {
+			e.remoteTargets = append(e.remoteTargets, target)
+		}
+	}
+}
+
+// addressingFamily returns the pod address family setting covering the
+// families enabled in the node addressing, or an empty string if none is
+// reported.
+func addressingFamily(addressing *models.NodeAddressing) string {
+	if addressing == nil {
+		return ""
+	}
+	v4 := addressing.IPV4 != nil && addressing.IPV4.Enabled
+	v6 := addressing.IPV6 != nil && addressing.IPV6.Enabled
+	switch {
+	case v4 && v6:
+		return familyDual
+	case v4:
+		return familyIPv4
+	case v6:
+		return familyIPv6
+	}
+	return ""
+}
+
+// getAddressingFamily fetches the node addressing from Cilium, and returns
+// the pod address family setting covering the enabled families.
+func getAddressingFamily() (string, error) {
+	client, err := clientPkg.NewClient("")
+	if err != nil {
+		return "", err
+	}
+	config, err := client.ConfigGet()
+	if err != nil {
+		return "", err
+	}
+	if config.Status == nil {
+		return "", fmt.Errorf("no node addressing reported")
+	}
+	family := addressingFamily(config.Status.Addressing)
+	if family == "" {
+		return "", fmt.Errorf("no address family enabled")
+	}
+	return family, nil
+}
+
+// endpoints fetches information about endpoints from Cilium, along with the
+// allocation ranges of the local node. Returns an error if Cilium cannot be
+// reached or listing the endpoints fails for any reason.
 func getEndpoints() (*endpointInfo, error) {
 	client, err := clientPkg.NewClient("")
 	if err != nil {
@@ -100,6 +234,27 @@ func getEndpoints() (*endpointInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	result := newEndpointInfoFromEndpoints(eps)
+
+	config, err := client.ConfigGet()
+	if err != nil {
+		log.WithError(err).Warn("Failed to fetch Cilium configuration")
+	} else if config.Status != nil && config.Status.Addressing != nil {
+		result.addAllocRange(config.Status.Addressing.IPV4)
+		result.addAllocRange(config.Status.Addressing.IPV6)
+	}
+
+	if verify && len(verifyTargets) == 0 {
+		status, err := client.Daemon.GetHealthz(nil)
+		if err != nil {
+			log.WithError(err).Warn("Failed to fetch Cilium cluster status")
+		} else if status.Payload != nil {
+			result.addRemoteTargets(status.Payload.Cluster)
+		}
+		if len(result.remoteTargets) == 0 {
+			log.Warn("No other nodes found, only verifying the path MTU to the default gateways")
+		}
+	}
 
-	return newEndpointInfoFromEndpoints(eps), nil
+	return result, nil
 }
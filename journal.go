@@ -0,0 +1,126 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	defaultJournalPath = "/var/lib/mtu-update/journal"
+)
+
+// journalEntry is a single change recorded in the journal, together with
+// the namespace in which it was made.
+type journalEntry struct {
+	Namespace uint64 `json:"namespace"`
+	PIDs      []int  `json:"pids,omitempty"`
+	change
+}
+
+// journal records every change made to links and routes on the node, so
+// that the changes can be rolled back later. Entries are stored as one JSON
+// object per line, and are only ever appended. It is safe for concurrent use.
+type journal struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// openJournal opens the journal at the specified path for appending,
+// creating it if it does not exist.
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{
+		file: f,
+		enc:  json.NewEncoder(f),
+	}, nil
+}
+
+// record appends the change made in the specified namespace to the journal
+// and flushes it to disk. This is done before applying the change, so that
+// a change is never applied without being recorded first.
+func (j *journal) record(ns *namespace, c *change) error {
+	if j == nil {
+		return nil
+	}
+	entry := &journalEntry{
+		Namespace: ns.inode,
+		PIDs:      ns.pids,
+		change:    *c,
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.enc.Encode(entry); err != nil {
+		return fmt.Errorf("failed to write journal: %s", err)
+	}
+	return j.file.Sync()
+}
+
+// Close closes the journal.
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// readJournal reads all entries from the journal at the specified path, in
+// the order in which they were recorded. An invalid last entry is ignored:
+// it was truncated while being recorded, so the change was never applied.
+func readJournal(path string) ([]*journalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		entries []*journalEntry
+		invalid error
+	)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if invalid != nil {
+			return nil, invalid
+		}
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := &journalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			invalid = fmt.Errorf("invalid journal entry on line %d: %s",
+				line, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if invalid != nil {
+		log.WithError(invalid).Warn("Ignoring truncated journal entry")
+	}
+
+	return entries, nil
+}
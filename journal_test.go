@@ -0,0 +1,118 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// journalChanges are changes recorded in the journal by the tests.
+var journalChanges = []change{
+	{Kind: changeLink, Link: "cilium_host", Ifindex: 2, OldMTU: 1500, NewMTU: 9001},
+	{Kind: changeRoute, Link: "eth0", Ifindex: 3, Route: "default via 10.0.0.1",
+		OldMTU: 1450, NewMTU: 8951, RouteFamily: familyIPv4, RouteGw: "10.0.0.1",
+		RouteTable: 254, OldLocked: true, NewLocked: true},
+	{Kind: changeClamp, Class: "iptables", NewRules: []string{"-p tcp -j TCPMSS"}},
+}
+
+// writeJournal records 'changes' in a new journal in 'dir', alternating
+// between two namespaces, followed by 'trailer'. Returns the path of the
+// journal and the entries expected to be read back.
+func writeJournal(t *testing.T, dir string, changes []change, trailer string) (string, []*journalEntry) {
+	path := filepath.Join(dir, "journal")
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatalf("failed to open journal: %s", err)
+	}
+	namespaces := []*namespace{
+		{inode: 4026531840},
+		{inode: 4026532200, pids: []int{1234, 5678}},
+	}
+
+	var expected []*journalEntry
+	for i := range changes {
+		ns := namespaces[i%len(namespaces)]
+		if err := j.record(ns, &changes[i]); err != nil {
+			t.Fatalf("failed to record change: %s", err)
+		}
+		expected = append(expected, &journalEntry{
+			Namespace: ns.inode,
+			PIDs:      ns.pids,
+			change:    changes[i],
+		})
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("failed to close journal: %s", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(trailer); err != nil {
+		t.Fatal(err)
+	}
+	return path, expected
+}
+
+func TestReadJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtu-update-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		changes []change
+		trailer string
+		invalid bool
+	}{
+		{name: "empty"},
+		{name: "entries", changes: journalChanges},
+		{name: "empty lines", changes: journalChanges, trailer: "\n\n"},
+		{name: "truncated last entry", changes: journalChanges,
+			trailer: `{"namespace":4026531840,"kind":"li`},
+		{name: "invalid entry", changes: journalChanges,
+			trailer: "{\"namespace\":\n" + `{"namespace":4026531840,"kind":"link"}` + "\n",
+			invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, expected := writeJournal(t, dir, tt.changes, tt.trailer)
+			defer os.Remove(path)
+
+			entries, err := readJournal(path)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("read %d entries, expected an error", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read journal: %s", err)
+			}
+			if !reflect.DeepEqual(entries, expected) {
+				t.Errorf("read entries %v, expected %v", entries, expected)
+			}
+		})
+	}
+}
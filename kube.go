@@ -0,0 +1,251 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// serviceAccountDir holds the credentials of the service account
+	// of pods running in the cluster.
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	kubeTimeout = 30 * time.Second
+)
+
+// kubeNode is the subset of a Kubernetes Node used by the controller.
+type kubeNode struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+// kubeContainerState is the subset of a Kubernetes ContainerState used by
+// the controller.
+type kubeContainerState struct {
+	Terminated *struct {
+		ExitCode int `json:"exitCode"`
+	} `json:"terminated,omitempty"`
+}
+
+// kubePod is the subset of a Kubernetes Pod used by the controller.
+type kubePod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string `json:"phase"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+		ContainerStatuses []struct {
+			State     kubeContainerState `json:"state"`
+			LastState kubeContainerState `json:"lastState"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// kubeClient is the subset of the Kubernetes API used by the controller and
+// to look up the labels of the node for the config file overrides.
+// It is implemented by restKubeClient against a real API server, and can
+// be implemented by a fake clientset to exercise the controller.
+type kubeClient interface {
+	// ListNodes returns the nodes matching the label selector.
+	ListNodes(selector string) ([]kubeNode, error)
+
+	// GetNode returns the node with the specified name.
+	GetNode(name string) (*kubeNode, error)
+
+	// PatchNode merges the labels and annotations into those of the
+	// node with the specified name.
+	PatchNode(name string, labels, annotations map[string]string) error
+
+	// ListPods returns the pods in the namespace matching the label
+	// selector which are scheduled on the specified node.
+	ListPods(namespace, selector, nodeName string) ([]kubePod, error)
+
+	// GetRunStatus returns the status of the run served on 'port' by the
+	// mtu-update pod with the specified name, see serveHealth().
+	GetRunStatus(namespace, name string, port int) (*runStatus, error)
+}
+
+// restKubeClient talks to the Kubernetes API server over HTTP(S).
+type restKubeClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+// newKubeClient returns a client for the API server at 'server'. If 'server'
+// is empty, the in-cluster configuration of the pod's service account is
+// used; otherwise no credentials are sent, eg for use with `kubectl proxy`.
+func newKubeClient(server string) (*restKubeClient, error) {
+	if server != "" {
+		return &restKubeClient{
+			server: strings.TrimSuffix(server, "/"),
+			client: &http.Client{Timeout: kubeTimeout},
+		}, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster and no API server specified")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %s", err)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account CA")
+	}
+
+	return &restKubeClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		token:  strings.TrimSpace(string(token)),
+		client: &http.Client{
+			Timeout: kubeTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// do sends a request to the API server, and decodes the response into
+// 'result' if it is not nil.
+func (c *restKubeClient) do(method, path string, query url.Values, body []byte, contentType string, result interface{}) error {
+	u := c.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status,
+			strings.TrimSpace(string(data)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+func (c *restKubeClient) ListNodes(selector string) ([]kubeNode, error) {
+	query := url.Values{}
+	if selector != "" {
+		query.Set("labelSelector", selector)
+	}
+	var list struct {
+		Items []kubeNode `json:"items"`
+	}
+	if err := c.do("GET", "/api/v1/nodes", query, nil, "", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *restKubeClient) GetNode(name string) (*kubeNode, error) {
+	node := &kubeNode{}
+	if err := c.do("GET", "/api/v1/nodes/"+url.PathEscape(name), nil, nil, "", node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (c *restKubeClient) PatchNode(name string, labels, annotations map[string]string) error {
+	// A null value would remove all labels or annotations, so only
+	// include those which are set.
+	metadata := map[string]interface{}{}
+	if labels != nil {
+		metadata["labels"] = labels
+	}
+	if annotations != nil {
+		metadata["annotations"] = annotations
+	}
+	body, err := json.Marshal(map[string]interface{}{"metadata": metadata})
+	if err != nil {
+		return err
+	}
+	return c.do("PATCH", "/api/v1/nodes/"+url.PathEscape(name), nil, body,
+		"application/merge-patch+json", nil)
+}
+
+func (c *restKubeClient) ListPods(namespace, selector, nodeName string) ([]kubePod, error) {
+	query := url.Values{}
+	query.Set("labelSelector", selector)
+	query.Set("fieldSelector", "spec.nodeName="+nodeName)
+	var list struct {
+		Items []kubePod `json:"items"`
+	}
+	path := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods"
+	if err := c.do("GET", path, query, nil, "", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// GetRunStatus reads the status through the pod proxy of the API server, so
+// that the pods need not be reachable from the controller.
+func (c *restKubeClient) GetRunStatus(namespace, name string, port int) (*runStatus, error) {
+	status := &runStatus{}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s:%d/proxy/status",
+		url.PathEscape(namespace), url.PathEscape(name), port)
+	if err := c.do("GET", path, nil, nil, "", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
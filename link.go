@@ -16,13 +16,15 @@ package main
 
 import (
 	"fmt"
-	"strings"
+	"sort"
 
 	"github.com/vishvananda/netlink"
 )
 
-const (
-	innerLinkType = "veth"
+var (
+	// defaultPodLinkTypes are the types of links which Cilium attaches to
+	// pods in veth, ipvlan and netkit datapath modes.
+	defaultPodLinkTypes = []string{"veth", "ipvlan", "netkit"}
 )
 
 // linkInfo caches relevant information from the link / address probe for a
@@ -39,110 +41,202 @@ func newLinkInfo(link netlink.Link, addrs []netlink.Addr) *linkInfo {
 	}
 }
 
-// scanLinks finds all links in the current namespace and returns them.
-func scanLinks() ([]netlink.Link, error) {
-	scopedLog.Debug("Fetching links")
+// scanLinks finds all links in the namespace and returns them.
+func scanLinks(ns *namespace) ([]netlink.Link, error) {
+	ns.log.Debug("Fetching links")
 
-	allLinks, err := netlink.LinkList()
+	allLinks, err := ns.nl.LinkList()
 	if err != nil {
 		return nil, err
 	}
 
-	scopedLog.Debugf("Found %d links", len(allLinks))
+	ns.log.Debugf("Found %d links", len(allLinks))
 	for _, link := range allLinks {
 		attrs := link.Attrs()
-		scopedLog.Debugf("  %s", attrs.Name)
-		scopedLog.Debugf("    Type: %s", link.Type())
+		ns.log.Debugf("  %s", attrs.Name)
+		ns.log.Debugf("    Type: %s", link.Type())
 		switch link.Type() {
 		case "device":
-			scopedLog.Debugf("    MTU: %d", attrs.MTU)
+			ns.log.Debugf("    MTU: %d", attrs.MTU)
 		case "veth":
-			scopedLog.Debugf("    MTU: %d", attrs.MTU)
+			ns.log.Debugf("    MTU: %d", attrs.MTU)
 		}
 	}
 
 	return allLinks, nil
 }
 
-// getPrimaryLink fetches the primary link in the current namespace - ie link
-// with the first ifindex (after loopback).
-func getPrimaryLink() (*linkInfo, error) {
-	links, err := scanLinks()
+// isPodLinkType returns true if links of the specified type may be attached
+// to pods by Cilium.
+func isPodLinkType(linkType string) bool {
+	for _, t := range podLinkTypes {
+		if t == linkType {
+			return true
+		}
+	}
+	return false
+}
+
+// getPodLinks fetches all links in the namespace whose type may be attached
+// to pods by Cilium, in ifindex order, along with their addresses of all
+// families.
+func getPodLinks(ns *namespace) ([]*linkInfo, error) {
+	links, err := scanLinks(ns)
 	if err != nil {
 		return nil, err
 	}
 
+	result := make([]*linkInfo, 0, 1)
 	for _, link := range links {
-		if link.Type() == innerLinkType {
-			addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
-			if err != nil {
-				scopedLog.Infof("Failed to fetch address info for link %s", link.Attrs().Name)
-				continue
-			}
-			return newLinkInfo(link, addrs), nil
+		if !isPodLinkType(link.Type()) {
+			continue
+		}
+		addrs, err := ns.nl.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch address info for link %s: %s",
+				link.Attrs().Name, err)
 		}
+		result = append(result, newLinkInfo(link, addrs))
 	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Attrs().Index < result[j].Attrs().Index
+	})
 
-	return nil, fmt.Errorf("failed to find primary link in %+v", links)
+	return result, nil
 }
 
-// updateHostLinks sets the MTU for links in the host namespace, both for host
-// side of veths that containers use, and the cilium devices.
-//
-// Returns the number of updates that failed.
-func updateHostLinks(allLinks []netlink.Link, deviceMTU int, epInfo *endpointInfo) int {
-	log.Debug("Updating host namespace devices")
-	var (
-		skipped int
-		failed  int
-		updated int
-	)
+// setLinkMTU records a change of the MTU of the link in namespace 'ns' to
+// 'mtu', and unless running in dry-run mode or planning the preflight 'p',
+// applies it. The change is checked by the preflight, if any.
+func setLinkMTU(ns *namespace, link netlink.Link, mtu int, p *preflight) (*change, error) {
+	attrs := link.Attrs()
+	c := &change{
+		Kind:    changeLink,
+		Link:    attrs.Name,
+		Ifindex: attrs.Index,
+		OldMTU:  attrs.MTU,
+		NewMTU:  mtu,
+	}
+	p.check(ns, link, mtu)
+	if dryRun || p != nil {
+		return c, nil
+	}
+	if err := changeJournal.record(ns, c); err != nil {
+		return c, err
+	}
 
-	// First, set all of the veths to allow reception of larger MTU.
-	ciliumLinks := make([]netlink.Link, 0, 4)
+	return c, ns.nl.LinkSetMTU(link, mtu)
+}
+
+// updateHostLink sets the MTU for the specified link in the host namespace
+// to 'mtu' and records the result in 'lr', see setLinkMTU(). Returns true if
+// the update succeeded.
+func updateHostLink(host *namespace, link netlink.Link, mtu int, lr *linkReport, p *preflight) bool {
+	name := link.Attrs().Name
+	log.Debugf("Updating MTU for device %s", name)
+	c, err := setLinkMTU(host, link, mtu, p)
+	lr.Change = c
+	if err != nil {
+		lr.Error = err.Error()
+		log.WithError(err).Warnf("Failed to set link MTU for %s", name)
+		return false
+	}
+	return true
+}
+
+// hostUpdate is a pending change of the MTU of a link in the host namespace.
+type hostUpdate struct {
+	link netlink.Link
+	mtu  int
+	lr   *linkReport
+}
+
+// planHostLinks records every link in 'allLinks' in 'rep', and returns the
+// pending changes of the cilium devices whose MTU differs from the MTU
+// determined by their rule, see lookupDeviceRule(). The host side of veths
+// is updated together with the pod side, see recordHostPeers().
+func planHostLinks(allLinks []netlink.Link, deviceMTU, tunnelMTU int, rep *report) []hostUpdate {
+	updates := make([]hostUpdate, 0, 4)
 	for _, link := range allLinks {
 		name := link.Attrs().Name
-		if link.Attrs().MTU == deviceMTU {
-			log.Debugf("Device %s has desired MTU", name)
-			skipped++
+		lr := rep.addHostLink(link)
+		rule, ok := lookupDeviceRule(name)
+		if !ok {
+			if link.Attrs().MTU == deviceMTU {
+				lr.Skipped = skipMTUMatches
+			} else {
+				lr.Skipped = skipNotManaged
+			}
 			continue
 		}
-		if strings.HasPrefix(name, "cilium") {
-			// Don't count; just add to ciliumLinks
-			ciliumLinks = append(ciliumLinks, link)
-		} else if epInfo.managedLink(name) {
-			log.Debugf("Updating MTU for device %s", name)
-			if err := netlink.LinkSetMTU(link, deviceMTU); err == nil {
-				updated++
-			} else {
-				failed++
-				log.WithError(err).Warn(
-					"Failed to set link MTU for %s", name)
+		lr.Rule = rule.String()
+		mtu := rule.targetMTU(deviceMTU, tunnelMTU)
+		switch {
+		case rule.kind == ruleSkip:
+			log.Debugf("Device %s is skipped by rule", name)
+			lr.Skipped = skipRule
+		case link.Attrs().MTU == mtu:
+			log.Debugf("Device %s has desired MTU", name)
+			lr.Skipped = skipMTUMatches
+		default:
+			updates = append(updates, hostUpdate{
+				link: link,
+				mtu:  mtu,
+				lr:   lr,
+			})
+		}
+	}
+	return updates
+}
+
+// recordHostPeers records the outcome for the host links in 'rep' which were
+// handled together with their peer in a pod namespace.
+func recordHostPeers(rep *report) {
+	paired := make(map[int]*podLinkReport)
+	for _, nsr := range rep.Namespaces {
+		for _, plr := range nsr.Links {
+			if plr.PeerIfindex != 0 {
+				paired[plr.PeerIfindex] = plr
 			}
-		} else {
-			skipped++
 		}
 	}
 
-	// Next, set all of the cilium devices to allow transmit of larger MTU.
-	for _, link := range ciliumLinks {
-		name := link.Attrs().Name
-		if link.Attrs().MTU == deviceMTU {
-			log.Debugf("Device %s has desired MTU", name)
-			skipped++
+	for _, lr := range rep.HostLinks {
+		plr, ok := paired[lr.Ifindex]
+		if !ok {
 			continue
 		}
-		log.Debugf("Updating MTU for device %s", name)
-		if err := netlink.LinkSetMTU(link, deviceMTU); err == nil {
-			updated++
-		} else {
-			failed++
-			log.WithError(err).Warnf(
-				"Failed to set link MTU for %s", name)
+		log.Debugf("Device %s was handled with its peer %s",
+			lr.Name, plr.Name)
+		lr.Endpoint = plr.Endpoint
+		lr.Change = plr.PeerChange
+		switch {
+		case lr.Change != nil:
+			lr.Skipped = skipPairUpdated
+		case plr.Error != "":
+			lr.Skipped = skipPairFailed
 		}
 	}
+}
 
-	log.Infof("Updated %d/%d local devices, %d skipped, %d failed",
-		updated, len(allLinks), skipped, failed)
-	return failed
+// logHostLinks summarizes the outcome for the host links in 'rep', see
+// logSummary().
+func logHostLinks(rep *report, p *preflight) {
+	var (
+		skipped int
+		failed  int
+		updated int
+	)
+	for _, lr := range rep.HostLinks {
+		switch {
+		case lr.Error != "":
+			failed++
+		case lr.Skipped != "":
+			skipped++
+		case lr.Change != nil:
+			updated++
+		}
+	}
+	logSummary(p, "%s %d/%d local devices, %d skipped, %d failed",
+		updatedVerb(p), updated, len(rep.HostLinks), skipped, failed)
 }
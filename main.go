@@ -16,18 +16,37 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"time"
 
 	pkgMTU "github.com/cilium/cilium/pkg/mtu"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/vishvananda/netlink"
 )
 
 const (
 	autodetectMTU = 0
+
+	// Sources of the device MTU, see resolveBaseMTU().
+	mtuFromFlag     = "flag"
+	mtuFromAgent    = "agent"
+	mtuFromDevice   = "device"
+	mtuFromPlatform = "platform"
+	mtuFromDefault  = "default"
+
+	// All IPv4 hosts must be able to receive 576B datagrams (RFC791), and
+	// every IPv6 link must have an MTU of at least 1280B (RFC8200).
+	minMTUIPv4 = 576
+	minMTUIPv6 = 1280
+
+	outputText = "text"
+	outputJSON = "json"
 )
 
 var (
@@ -44,14 +63,158 @@ var (
 	deviceMTU int
 
 	// tunnelOverhead is the overhead used for configuring routes to
-	// remote nodes.
+	// remote nodes. If not specified, it is computed from the
+	// encapsulation.
 	tunnelOverhead int
 
+	// encapsulation is the tunnel protocol used between nodes. Stacked
+	// encapsulations are separated by encapSeparator.
+	encapsulation string
+
+	// autoConfig will cause the MTU and encapsulation to be derived from
+	// the Cilium agent configuration if true.
+	autoConfig bool
+
+	// force will cause flags which contradict the Cilium agent
+	// configuration to take precedence if true.
+	force bool
+
+	// underlayFamily is the address family of the underlay network
+	// carrying the tunnel, either ipv4, ipv6 or dual.
+	underlayFamily string
+
+	// geneveOptionLen is the length of the Geneve options in bytes.
+	geneveOptionLen int
+
+	// ipsecCipher is the cipher suite used for IPsec ESP.
+	ipsecCipher string
+
+	// podFamily selects the address families of pods which are matched
+	// against endpoints and whose routes are updated, either ipv4, ipv6
+	// or dual. familyAuto is resolved to the families enabled in Cilium
+	// by resolvePodFamily() before the update.
+	podFamily string
+
+	// deviceRuleSpecs are the unparsed values of deviceRuleOverrides.
+	deviceRuleSpecs []string
+
+	// platform is the cloud platform whose profile supplies the base MTU,
+	// or platformAuto to detect it. If empty, no profile is used.
+	platform string
+
+	// metadataEndpoint is the address of the instance metadata service
+	// used to detect the platform and read its settings.
+	metadataEndpoint string
+
+	// uplinkDevice is the device whose MTU is autodetected. If empty, the
+	// device is found through the node IP or the default route.
+	uplinkDevice string
+
+	// podLinkTypes are the types of links in pod namespaces which are
+	// matched against endpoints.
+	podLinkTypes []string
+
+	// configFile is the path of the config file. If empty, all settings
+	// are taken from the flags.
+	configFile string
+
+	// setAdvMSS will cause the advertised TCP MSS of updated routes to be
+	// derived from their MTU if true.
+	setAdvMSS bool
+
+	// lockRouteMTU will cause the MTU of updated routes to be locked
+	// against path MTU discovery if true.
+	lockRouteMTU bool
+
+	// clampTargets selects where MSS clamping rules are installed, either
+	// clampPod, clampHost or both. If empty, no rules are installed.
+	clampTargets []string
+
+	// clampBackendName is the backend used to install MSS clamping
+	// rules, either clampIPTables or clampNFTables.
+	clampBackendName string
+
 	// verbose will cause debug messages to be printed if true.
 	verbose bool
 
-	log       *logrus.Logger
-	scopedLog *logrus.Entry
+	// watch will cause the MTU of new pods to be reconciled continuously
+	// if true.
+	watch bool
+
+	// resyncInterval is the interval at which all namespaces and links
+	// are updated in watch mode.
+	resyncInterval time.Duration
+
+	// metricsAddress is the address to serve Prometheus metrics on. If
+	// empty, metrics are not served.
+	metricsAddress string
+
+	// runMetrics tracks the results of updates. If nil, no metrics are
+	// tracked.
+	runMetrics *metricsRegistry
+
+	// healthAddress is the address to serve the health, readiness and
+	// status endpoints on. If empty, they are not served.
+	healthAddress string
+
+	// runState tracks the state of the run for the status endpoints. If
+	// nil, no state is tracked.
+	runState *runStatus
+
+	// journalPath is the path of the journal used to record changes so
+	// that they can be rolled back.
+	journalPath string
+
+	// changeJournal records every change before it is applied. If nil,
+	// changes are not recorded.
+	changeJournal *journal
+
+	// dryRun will cause the planned changes to be printed rather than
+	// applied if true.
+	dryRun bool
+
+	// outputFormat selects how the result of the run is printed to
+	// stdout, either outputText or outputJSON.
+	outputFormat string
+
+	// reportFile is the path to write a JSON report of the run to. If
+	// empty, no report file is written.
+	reportFile string
+
+	// routeSelection selects which routes are updated in each namespace,
+	// either routesDefault or routesAll.
+	routeSelection string
+
+	// clusterCIDRs are the CIDRs of pods across the cluster, used to
+	// classify routes towards remote nodes.
+	clusterCIDRs []*net.IPNet
+
+	// clusterCIDRStrings are the unparsed values of clusterCIDRs.
+	clusterCIDRStrings []string
+
+	// verify will cause the path MTU to be probed from within each
+	// updated namespace if true.
+	verify bool
+
+	// verifyTargets are the addresses to probe when verifying the path
+	// MTU. If empty, the default gateways are probed.
+	verifyTargets []string
+
+	// verifyTimeout is how long to wait for the reply to each probe.
+	verifyTimeout time.Duration
+
+	// netnsSources are the names of the sources used to discover network
+	// namespaces.
+	netnsSources []string
+
+	// netnsDirs are the directories searched for bind-mounted network
+	// namespaces.
+	netnsDirs []string
+
+	// parallelism is the number of namespaces to update concurrently.
+	parallelism int
+
+	log *logrus.Logger
 )
 
 func main() {
@@ -65,104 +228,631 @@ func init() {
 	flags.IntVarP(&deviceMTU, "mtu", "m", pkgMTU.EthernetMTU,
 		"Base MTU to configure on links (0 for autodetect)")
 	flags.IntVarP(&tunnelOverhead, "tunnel-overhead", "t", pkgMTU.TunnelOverhead,
-		"Expected tunnel overhead for overlay traffic")
-	flags.BoolVarP(&verbose, "verbose", "v", false,
-		"Print verbose debug log messages")
+		"Expected tunnel overhead for overlay traffic (overrides --encapsulation)")
+	flags.StringVarP(&encapsulation, "encapsulation", "e", encapVXLAN,
+		"Encapsulation between nodes (vxlan, geneve, ipip, gre, wireguard, ipsec or none), stacked with '+'")
+	flags.StringVar(&underlayFamily, "underlay-family", familyIPv4,
+		"Address family of the underlay network (ipv4, ipv6 or dual)")
+	flags.StringVar(&podFamily, "family", familyAuto,
+		"Address families of pods to update (ipv4, ipv6, dual or auto for those enabled in Cilium)")
+	flags.StringSliceVar(&podLinkTypes, "pod-link-type", defaultPodLinkTypes,
+		"Types of links in pod namespaces to match against endpoints")
+	flags.StringSliceVar(&deviceRuleSpecs, "device-rule", nil,
+		"MTU rule for a host device as <device>=<device|tunnel|skip|MTU>, eg cilium_vxlan=tunnel")
+	flags.StringVar(&platform, "platform", "",
+		"Cloud platform supplying the base MTU unless --mtu or --device is given, and the overhead of its network (gcp, aws, azure or auto to detect)")
+	flags.StringVar(&metadataEndpoint, "metadata-endpoint", defaultMetadataEndpoint,
+		"Address of the instance metadata service used with --platform")
+	flags.StringVar(&uplinkDevice, "device", "",
+		"Device to autodetect the MTU from unless --mtu is given (default: the device of the node IP or default route)")
+	flags.IntVar(&geneveOptionLen, "geneve-option-length", 0,
+		"Length of Geneve options in bytes")
+	flags.StringVar(&ipsecCipher, "ipsec-cipher", "aes-gcm",
+		"IPsec ESP cipher (aes-gcm, chacha20-poly1305, aes-cbc-sha256 or aes-cbc-sha1)")
+	flags.BoolVarP(&autoConfig, "auto", "a", false,
+		"Derive the MTU and encapsulation from the Cilium agent configuration")
+	flags.BoolVar(&force, "force", false,
+		"Proceed even if flags contradict the Cilium agent configuration")
+	flags.BoolVarP(&dryRun, "dry-run", "n", false,
+		"Print the planned changes without applying them")
+	flags.BoolVarP(&watch, "watch", "w", false,
+		"Keep running and update the MTU of new pods as they appear")
+	flags.DurationVar(&resyncInterval, "resync-interval", 10*time.Minute,
+		"Interval between full updates in watch mode")
+	flags.StringVar(&metricsAddress, "metrics-address", "",
+		"Address to serve Prometheus metrics on, eg :9090 (empty to disable)")
+	flags.StringVar(&healthAddress, "health-address", "",
+		"Address to serve /healthz, /readyz and /status on, eg :9876 (empty to disable)")
+	flags.IntVarP(&parallelism, "parallelism", "p", 4,
+		"Number of namespaces to update concurrently")
+	flags.StringVar(&routeSelection, "routes", routesDefault,
+		"Routes to update in each namespace (default or all)")
+	flags.BoolVar(&setAdvMSS, "advmss", false,
+		"Set the advertised TCP MSS of updated routes from their MTU")
+	flags.BoolVar(&lockRouteMTU, "lock-mtu", false,
+		"Lock the MTU of updated routes against path MTU discovery")
+	flags.StringSliceVar(&clampTargets, "mss-clamp", nil,
+		"Install TCP MSS clamping rules for the tunnel MTU in pod namespaces and/or the host (pod, host)")
+	flags.StringVar(&clampBackendName, "mss-clamp-backend", clampIPTables,
+		"Backend for MSS clamping rules (iptables or nftables)")
+	flags.StringSliceVar(&clusterCIDRStrings, "cluster-cidr", nil,
+		"Pod CIDRs of the cluster, used to classify routes to remote nodes")
+	flags.BoolVar(&verify, "verify", false,
+		"Probe the path MTU from within each updated namespace")
+	flags.StringSliceVar(&verifyTargets, "verify-target", nil,
+		"Addresses to probe when verifying (default: another node and the default gateways)")
+	flags.DurationVar(&verifyTimeout, "verify-timeout", time.Second,
+		"Time to wait for the reply to each verification probe")
+	flags.StringVarP(&outputFormat, "output", "o", outputText,
+		"Output format for the result of the run (text or json)")
+	flags.StringVar(&reportFile, "report-file", "",
+		"Path to write a JSON report of the run to (empty to disable)")
+	flags.StringVarP(&configFile, "config", "c", "",
+		"Path of a YAML or TOML config file with settings and per-node overrides")
 	viper.BindPFlags(flags)
 
+	persistentFlags := rootCmd.PersistentFlags()
+	persistentFlags.BoolVarP(&verbose, "verbose", "v", false,
+		"Print verbose debug log messages")
+	persistentFlags.StringVarP(&journalPath, "journal", "j", defaultJournalPath,
+		"Path of the journal recording changes for rollback (empty to disable)")
+	persistentFlags.StringSliceVar(&netnsSources, "netns-source",
+		[]string{sourceProc, sourceBindMount, sourceFD},
+		"Sources to discover network namespaces from (proc, bind or fd)")
+	persistentFlags.StringSliceVar(&netnsDirs, "netns-dir", defaultNetnsDirs,
+		"Directories to search for bind-mounted network namespaces")
+	viper.BindPFlags(persistentFlags)
+
 	logrus.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
 	log = logrus.StandardLogger()
-	scopedLog = logrus.NewEntry(log)
 }
 
-// detectMTU searches through the provided list of links for real devices and
-// returns the lowest MTU amongst the specified devices. If no real devices
-// can be found, returns an error.
-func detectMTU(links []netlink.Link) (int, error) {
-	log.Debug("Autodetecting MTU")
+// minMTU returns the minimum MTU of links carrying packets of the family.
+func minMTU(family string) int {
+	if family == familyIPv6 {
+		return minMTUIPv6
+	}
+	return minMTUIPv4
+}
 
-	mtu := pkgMTU.MaxMTU
-	foundDevice := false
-	for _, link := range links {
-		if link.Type() != "device" {
-			continue
+// validateMTU checks that 'mtu', described by 'what', is within the range
+// allowed for each of the families carried over it.
+func validateMTU(what string, mtu int, families []string) error {
+	if mtu > pkgMTU.MaxMTU {
+		return fmt.Errorf("%s %d exceeds the maximum of %d", what, mtu,
+			pkgMTU.MaxMTU)
+	}
+	for _, family := range families {
+		if mtu < minMTU(family) {
+			return fmt.Errorf("%s %d is below the %s minimum of %d",
+				what, mtu, family, minMTU(family))
 		}
-		foundDevice = true
-		attrs := link.Attrs()
-		if attrs.MTU < mtu {
-			log.Debugf("Link %s forces lower MTU %d",
-				attrs.Name, attrs.MTU)
-			mtu = attrs.MTU
+	}
+	return nil
+}
+
+// podFamilies returns the enabled pod address families.
+func podFamilies() []string {
+	result := make([]string, 0, 2)
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		if familyEnabled(family) {
+			result = append(result, family)
 		}
 	}
-	if !foundDevice {
-		return 0, fmt.Errorf("no physical devices found")
+	return result
+}
+
+// resolvePodFamily returns the pod address family setting covering the
+// families enabled in Cilium, as reported in the agent configuration if
+// available. Falls back to both families if Cilium does not report them.
+func resolvePodFamily(agent *agentConfig) string {
+	if agent != nil && agent.Family != "" {
+		return agent.Family
+	}
+	family, err := getAddressingFamily()
+	if err != nil {
+		log.WithError(err).Warnf("Failed to determine the address families enabled in Cilium, using %s",
+			familyDual)
+		return familyDual
+	}
+	return family
+}
+
+// validateTunnelMTU checks that the tunnel MTU can carry packets of every
+// enabled pod family.
+func validateTunnelMTU(tunnelMTU int) error {
+	return validateMTU("tunnel MTU", tunnelMTU, podFamilies())
+}
+
+// givenMTUSettings returns the "mtu", "device" and "platform" settings which
+// were given, in order of precedence: those on the command line, and then
+// those in the config file.
+func givenMTUSettings(flags *pflag.FlagSet) []string {
+	result := []string{}
+	for _, fromConfig := range []bool{false, true} {
+		for _, name := range []string{"mtu", "device", "platform"} {
+			if flags.Changed(name) && configSettings[name] == fromConfig {
+				result = append(result, name)
+			}
+		}
 	}
+	return result
+}
 
-	return mtu, nil
+// describeSetting describes how the named setting was given, for messages.
+func describeSetting(flags *pflag.FlagSet, name string) string {
+	value := flags.Lookup(name).Value.String()
+	if configSettings[name] {
+		return fmt.Sprintf("%s %s in the config file", name, value)
+	}
+	return fmt.Sprintf("--%s %s", name, value)
 }
 
-// sanitizeMTU takes the specified MTU and an optional set of links, and
-// validates the MTU configuration. If the MTU is not specified, autodetects
-// the value to be used.
+// resolveBaseMTU determines where the device MTU comes from, in order of
+// precedence: the first of --mtu, --device or --platform given on the
+// command line, the same given in the config file, the device MTU of the
+// Cilium agent with --auto, and the Ethernet default. deviceMTU is set
+// accordingly, autodetecting the MTU with 'detect' for --device, --mtu 0 and
+// platforms which take the MTU from the device, and the source is recorded
+// in 'rep'. The source is logged along with the settings it overrides.
 //
-// Returns the desired device MTU, MTU for tunnelled routes, and optional error.
-func sanitizeMTU(mtu int, links []netlink.Link) (int, int, error) {
-	var err error
-	if mtu == autodetectMTU {
-		mtu, err = detectMTU(links)
+// If the MTU given by a setting differs from the device MTU of the agent,
+// returns an error unless 'force' is true, in which case the setting is
+// kept. --mtu 0 only asks for autodetection, so gives way to the agent.
+//
+// With --platform, the platform is recorded in 'rep' even if it does not
+// supply the MTU, and the overhead of its network is returned, to be added
+// to the tunnel overheads.
+func resolveBaseMTU(flags *pflag.FlagSet, agent *agentConfig, force bool,
+	detect func() (int, error), rep *report) (int, error) {
+	var profile *platformProfile
+	client := newMetadataClient(metadataEndpoint)
+	if platform != "" {
+		var err error
+		profile, err = detectPlatform(platform, client)
 		if err != nil {
-			return 0, 0, fmt.Errorf("failed to autodetect MTU: %s", err)
+			return 0, err
 		}
+		rep.Platform = profile.name
+		rep.PlatformOverhead = profile.overhead
+	}
+
+	agentMTU := 0
+	if agent != nil {
+		agentMTU = agent.DeviceMTU
+	}
+	given := ""
+	ignored := givenMTUSettings(flags)
+	if len(ignored) > 0 {
+		given, ignored = ignored[0], ignored[1:]
+	}
+	if given == "mtu" && deviceMTU == autodetectMTU && agentMTU != 0 {
+		given = ""
 	}
 
-	// All hosts must be able to receive 576B datagrams (RFC791).
-	if mtu < 576 {
-		return 0, 0, fmt.Errorf("MTU %d is too short", mtu)
+	mtu := deviceMTU
+	rep.MTUSource = mtuFromDefault
+	switch given {
+	case "mtu":
+		rep.MTUSource = mtuFromFlag
+	case "device":
+		mtu = autodetectMTU
+		rep.MTUSource = mtuFromDevice
+	case "platform":
+		mtu = profile.baseMTU(client)
+		rep.MTUSource = mtuFromPlatform
+	}
+	if given != "" && mtu == autodetectMTU {
+		var err error
+		mtu, err = detect()
+		if err != nil {
+			return 0, fmt.Errorf("failed to autodetect MTU: %s", err)
+		}
 	}
 
-	// Maximum Geneve tunnel overhead is 310B (draft-ietf-nvo3-geneve-06).
-	if tunnelOverhead < 0 || tunnelOverhead > 310 {
-		return 0, 0, fmt.Errorf("invalid tunnel overhead %d",
-			tunnelOverhead)
+	if agentMTU != 0 {
+		switch {
+		case given == "":
+			mtu = agentMTU
+			rep.MTUSource = mtuFromAgent
+		case mtu != agentMTU && !force:
+			return 0, fmt.Errorf("flags contradict agent configuration: "+
+				"%s gives device MTU %d, agent uses %d",
+				describeSetting(flags, given), mtu, agentMTU)
+		case mtu != agentMTU:
+			log.Warnf("Ignoring agent configuration: %s gives device MTU %d, agent uses %d",
+				describeSetting(flags, given), mtu, agentMTU)
+		}
+	}
+	deviceMTU = mtu
+
+	source := "the Ethernet default"
+	switch {
+	case given != "":
+		source = describeSetting(flags, given)
+	case rep.MTUSource == mtuFromAgent:
+		source = "the Cilium agent"
+	}
+	log.Infof("Device MTU %d taken from %s", mtu, source)
+	for _, name := range ignored {
+		log.Warnf("Ignoring the MTU of %s, device MTU is taken from %s",
+			describeSetting(flags, name), source)
+	}
+
+	if profile == nil {
+		return 0, nil
+	}
+	return profile.overhead, nil
+}
+
+// sanitizeMTU takes the specified MTU and the tunnel overhead for each
+// underlay family, and validates the MTU configuration.
+//
+// The device MTU carries pod traffic as well as the underlay, so must be
+// valid for the enabled pod families and the underlay families. The tunnel
+// MTU of each underlay family carries pod traffic, so must be valid for the
+// enabled pod families. Fixed MTUs of device rules must be valid for the
+// same families as the device MTU.
+//
+// Returns the desired device MTU, MTU for tunnelled routes, and optional error.
+// When several underlay families are in use, the tunnel MTU is the lowest of
+// the MTUs of all families.
+func sanitizeMTU(mtu int, overheads map[string]int) (int, int, error) {
+	families := podFamilies()
+	for _, family := range sortedFamilies(overheads) {
+		if !familyEnabled(family) {
+			families = append(families, family)
+		}
+	}
+	if err := validateMTU("device MTU", mtu, families); err != nil {
+		return 0, 0, err
+	}
+	if err := validateDeviceRules(families); err != nil {
+		return 0, 0, err
+	}
+
+	tunnelMTU := mtu
+	for _, family := range sortedFamilies(overheads) {
+		overhead := overheads[family]
+		if overhead < 0 {
+			return 0, 0, fmt.Errorf("invalid %s tunnel overhead %d",
+				family, overhead)
+		}
+		what := fmt.Sprintf("tunnel MTU over %s underlay", family)
+		if err := validateMTU(what, mtu-overhead, podFamilies()); err != nil {
+			return 0, 0, fmt.Errorf("%s (device MTU %d less overhead %d)",
+				err, mtu, overhead)
+		}
+		if mtu-overhead < tunnelMTU {
+			tunnelMTU = mtu - overhead
+		}
 	}
-	tunnelMTU := mtu - tunnelOverhead
 
 	return mtu, tunnelMTU, nil
 }
 
+// updatedVerb returns the verb to use when summarizing updates, depending on
+// whether the changes are actually applied, see setLinkMTU().
+func updatedVerb(p *preflight) string {
+	if dryRun || p != nil {
+		return "Would update"
+	}
+	return "Updated"
+}
+
+// logSummary logs the summary of the updates in a pass. The summaries of the
+// preflight pass 'p' are only logged at debug level, as nothing is updated.
+func logSummary(p *preflight, format string, args ...interface{}) {
+	if p != nil {
+		log.Debugf(format, args...)
+		return
+	}
+	log.Infof(format, args...)
+}
+
+// writeReports writes the report to stdout in the selected output format,
+// and to the report file if one was specified.
+func writeReports(rep *report) {
+	switch outputFormat {
+	case outputText:
+		if dryRun {
+			rep.writePlan(os.Stdout)
+		}
+	case outputJSON:
+		if err := rep.writeJSON(os.Stdout); err != nil {
+			log.WithError(err).Warn("Failed to write report")
+		}
+	}
+
+	if reportFile != "" {
+		if err := rep.writeFile(reportFile); err != nil {
+			log.WithError(err).Warnf("Failed to write report to %s",
+				reportFile)
+		}
+	}
+}
+
+// serveUntilTerminated keeps serving the status endpoints, so that the
+// probes report the outcome of the run until the pod is removed.
+func serveUntilTerminated() {
+	log.Info("Serving status until terminated")
+	select {}
+}
+
+// fatal records the error in the report and the run status, and writes the
+// report out. If the status endpoints are served, they keep reporting the
+// failure, otherwise the process exits.
+func fatal(rep *report, err error, msg string) {
+	rep.Error = fmt.Sprintf("%s: %s", msg, err)
+	writeReports(rep)
+	if runState == nil {
+		log.WithError(err).Fatal(msg)
+	}
+	runState.fail(err, msg)
+	log.WithError(err).Error(msg)
+	serveUntilTerminated()
+}
+
+// updatePass updates the MTU of the managed namespaces in 'namespaces' and
+// the host links 'allLinks' in 'host' to the MTUs specified in 'rep'. If 'p'
+// is not nil, the changes are only planned and checked by the preflight,
+// otherwise they are applied. The outcome is recorded in 'rep'.
+//
+// Returns the number of operations that failed.
+func updatePass(host *namespace, allLinks []netlink.Link, namespaces []*namespace,
+	epInfo *endpointInfo, rep *report, p *preflight) int {
+	peers := newHostPeers(host, allLinks)
+	failed, _ := updateLinks(host, allLinks, rep.DeviceMTU, rep.TunnelMTU,
+		rep, p, func() (int, error) {
+			return updateNamespaceList(namespaces, rep.DeviceMTU,
+				rep.TunnelMTU, epInfo, peers, rep, p), nil
+		})
+	if clampEnabled(clampHost) {
+		if err := updateHostClamp(host, rep.TunnelMTU, rep, p); err != nil {
+			log.WithError(err).Warn("Failed to set MSS clamping rules")
+			failed++
+		}
+	}
+	return failed
+}
+
+// updateAll fetches the endpoints, links and namespaces on the node, and
+// plans the update of all managed namespaces and host links in 'host' to
+// the MTUs specified in 'rep', see runPreflight(). If the planned MTUs can
+// be applied to every link, applies the same plan with updatePass(). The
+// outcome is recorded in 'rep'.
+//
+// Returns the number of operations that failed, and an error if the
+// endpoints, links or namespaces could not be fetched, or the preflight
+// failed.
+func updateAll(host *namespace, rep *report) (int, error) {
+	start := time.Now()
+
+	epInfo, err := getEndpoints()
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch Cilium endpoints: %s", err)
+	}
+
+	allLinks, err := scanLinks(host)
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan available links: %s", err)
+	}
+
+	rootNamespace, namespaces, err := scanNamespaces()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find network namespaces: %s", err)
+	}
+	defer closeNamespaces(rootNamespace, namespaces)
+
+	err = runPreflight(host, allLinks, namespaces, epInfo, rep.DeviceMTU,
+		rep.TunnelMTU)
+	if err != nil {
+		return 0, fmt.Errorf("preflight failed: %s", err)
+	}
+	failed := updatePass(host, allLinks, namespaces, epInfo, rep, nil)
+	rep.Failed = failed
+	runMetrics.observe(passFull, rep, time.Since(start))
+	runState.observe(rep)
+
+	return failed, nil
+}
+
 func run(cmd *cobra.Command) {
 	var tunnelMTU int
 
 	if verbose {
 		log.Level = logrus.DebugLevel
 	}
+	if configFile != "" {
+		if err := loadConfig(configFile, cmd.Flags()); err != nil {
+			log.WithError(err).Fatalf("Failed to load config file %s", configFile)
+		}
+		if verbose {
+			log.Level = logrus.DebugLevel
+		}
+	}
+	if watch && dryRun {
+		log.Fatal("Watch mode cannot be combined with dry run")
+	}
+	if watch && resyncInterval <= 0 {
+		log.Fatalf("Invalid resync interval %s", resyncInterval)
+	}
+	if outputFormat != outputText && outputFormat != outputJSON {
+		log.Fatalf("Invalid output format %q", outputFormat)
+	}
+	if podFamily != familyIPv4 && podFamily != familyIPv6 && podFamily != familyDual &&
+		podFamily != familyAuto {
+		log.Fatalf("Invalid pod address family %q", podFamily)
+	}
+	for _, target := range clampTargets {
+		if target != clampPod && target != clampHost {
+			log.Fatalf("Invalid MSS clamping target %q", target)
+		}
+	}
+	if platform != "" {
+		if _, err := lookupPlatform(platform); err != nil {
+			log.WithError(err).Fatal("Invalid platform")
+		}
+	}
+	if _, err := newClampBackend(clampBackendName); err != nil {
+		log.WithError(err).Fatal("Invalid MSS clamping configuration")
+	}
+	if parallelism < 1 {
+		log.Fatalf("Invalid parallelism %d", parallelism)
+	}
+	if routeSelection != routesDefault && routeSelection != routesAll {
+		log.Fatalf("Invalid route selection %q", routeSelection)
+	}
+	if _, err := newNSSources(netnsSources, netnsDirs); err != nil {
+		log.WithError(err).Fatal("Invalid netns discovery configuration")
+	}
+	rules, err := parseDeviceRules(deviceRuleSpecs)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid device rules")
+	}
+	deviceRuleOverrides = rules
+	for _, s := range clusterCIDRStrings {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			log.WithError(err).Fatalf("Invalid cluster CIDR %q", s)
+		}
+		clusterCIDRs = append(clusterCIDRs, cidr)
+	}
 
-	epInfo, err := getEndpoints()
+	if healthAddress != "" {
+		runState = newRunStatus()
+		serveHealth(healthAddress, runState)
+	}
+
+	rep := newReport(0, 0)
+	host, err := currentNamespace()
 	if err != nil {
-		log.WithError(err).Fatalf("Failed to fetch Cilium endpoints")
+		fatal(rep, err, "Failed to get host netns")
 	}
+	defer host.Close()
 
-	allLinks, err := scanLinks()
+	allLinks, err := scanLinks(host)
 	if err != nil {
-		log.WithError(err).Fatalf("Failed to scan available links")
+		fatal(rep, err, "Failed to scan available links")
 	}
 
-	deviceMTU, tunnelMTU, err = sanitizeMTU(deviceMTU, allLinks)
+	var agent *agentConfig
+	if autoConfig {
+		agent, err = getAgentConfig()
+		if err != nil {
+			fatal(rep, err, "Failed to fetch Cilium agent configuration")
+		}
+		log.Infof("Cilium agent uses tunnel %q, encryption %q, device MTU %d, route MTU %d",
+			agent.Tunnel, agent.Encryption, agent.DeviceMTU, agent.RouteMTU)
+		if err := agent.apply(cmd.Flags(), force); err != nil {
+			fatal(rep, err, "Refusing to update MTU")
+		}
+		rep.Agent = agent
+	}
+	if podFamily == familyAuto {
+		podFamily = resolvePodFamily(agent)
+		log.Infof("Updating pod addresses and routes of family %s", podFamily)
+	}
+	platformOverhead, err := resolveBaseMTU(cmd.Flags(), agent, force,
+		func() (int, error) {
+			return detectMTU(host, allLinks)
+		}, rep)
+	if err != nil {
+		fatal(rep, err, "Failed to determine device MTU")
+	}
+
+	// With --auto, a tunnel overhead from the config file gives way to the
+	// encapsulation of the agent.
+	explicitOverhead := fromCommandLine(cmd.Flags(), "tunnel-overhead") ||
+		(cmd.Flags().Changed("tunnel-overhead") && agent == nil)
+	overheads, err := resolveTunnelOverheads(explicitOverhead)
+	if err != nil {
+		fatal(rep, err, "Invalid tunnel configuration")
+	}
+	for family := range overheads {
+		overheads[family] += platformOverhead
+	}
+	deviceMTU, tunnelMTU, err = sanitizeMTU(deviceMTU, overheads)
 	if err != nil {
-		log.WithError(err).Fatalf("Invalid MTU specified")
+		fatal(rep, err, "Invalid MTU specified")
+	}
+	if agent != nil {
+		tunnelMTU, err = agent.tunnelMTU(tunnelMTU, cmd.Flags(), force)
+		if err != nil {
+			fatal(rep, err, "Refusing to update MTU")
+		}
+		if err := validateTunnelMTU(tunnelMTU); err != nil {
+			fatal(rep, err, "Invalid MTU in agent configuration")
+		}
+	}
+	rep.DeviceMTU = deviceMTU
+	rep.TunnelMTU = tunnelMTU
+	rep.Encapsulation = encapsulation
+	rep.TunnelMTUByFamily = make(map[string]int, len(overheads))
+	for _, family := range sortedFamilies(overheads) {
+		rep.TunnelMTUByFamily[family] = deviceMTU - overheads[family]
+		log.Debugf("Tunnel MTU over %s underlay is %d", family,
+			deviceMTU-overheads[family])
 	}
 
 	log.Infof("Configuring MTU using base MTU %d, tunnel MTU %d",
 		deviceMTU, tunnelMTU)
+	if dryRun {
+		log.Info("Dry run, no changes will be applied")
+	}
+
+	if metricsAddress != "" {
+		runMetrics = newMetricsRegistry(deviceMTU, tunnelMTU)
+		serveMetrics(metricsAddress, runMetrics)
+	}
+
+	if !dryRun && journalPath != "" {
+		if err := os.MkdirAll(filepath.Dir(journalPath), 0755); err != nil {
+			fatal(rep, err, "Failed to create journal directory")
+		}
+		changeJournal, err = openJournal(journalPath)
+		if err != nil {
+			fatal(rep, err, "Failed to open journal")
+		}
+		defer changeJournal.Close()
+	}
+
+	// Subscribe to link events before the initial update, so that no
+	// links created in the meantime are missed.
+	var w *watcher
+	if watch {
+		w, err = newWatcher(host, deviceMTU, tunnelMTU)
+		if err != nil {
+			fatal(rep, err, "Failed to subscribe to link events")
+		}
+		defer w.Close()
+	}
 
 	// Perform the actual MTU update
-	failed, err := updateNamespaces(deviceMTU, tunnelMTU, epInfo)
+	runState.setPhase(phaseUpdating)
+	failed, err := updateAll(host, rep)
 	if err != nil {
-		log.WithError(err).Fatalf("Failed to find network namespaces")
+		fatal(rep, err, "Failed to update MTU")
+	}
+	writeReports(rep)
+
+	if watch {
+		if failed > 0 {
+			log.Warnf("%d MTU update operations failed, retrying on resync",
+				failed)
+		}
+		runState.setPhase(phaseWatching)
+		err = w.run(rep, resyncInterval)
+		fatal(rep, err, "Stopped watching for link events")
 	}
-	failed += updateHostLinks(allLinks, deviceMTU, epInfo)
 	if failed > 0 {
-		log.Fatalf("%d MTU update operations failed", failed)
+		fatal(rep, fmt.Errorf("%d operations failed", failed),
+			"MTU update partially failed")
+	}
+	runState.setPhase(phaseDone)
+
+	if runState != nil {
+		log.Info("Update complete")
+		serveUntilTerminated()
 	}
 }
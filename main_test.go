@@ -0,0 +1,124 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateMTU(t *testing.T) {
+	tests := []struct {
+		name     string
+		mtu      int
+		families []string
+		valid    bool
+	}{
+		{name: "ipv4", mtu: 1500, families: []string{familyIPv4}, valid: true},
+		{name: "ipv4 minimum", mtu: 576, families: []string{familyIPv4}, valid: true},
+		{name: "below ipv4 minimum", mtu: 575, families: []string{familyIPv4}},
+		{name: "ipv6 minimum", mtu: 1280, families: []string{familyIPv6}, valid: true},
+		{name: "below ipv6 minimum", mtu: 1279, families: []string{familyIPv6}},
+		{name: "maximum", mtu: 65520, families: []string{familyIPv4, familyIPv6}, valid: true},
+		{name: "above maximum", mtu: 65521, families: []string{familyIPv4}},
+		{name: "dual stack", mtu: 1500, families: []string{familyIPv4, familyIPv6}, valid: true},
+		{name: "dual stack below ipv6 minimum", mtu: 1000,
+			families: []string{familyIPv4, familyIPv6}},
+		{name: "no family", mtu: 100, valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMTU("MTU", tt.mtu, tt.families)
+			if tt.valid && err != nil {
+				t.Errorf("MTU %d rejected for %v: %s", tt.mtu, tt.families, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("MTU %d accepted for %v, expected an error", tt.mtu, tt.families)
+			}
+		})
+	}
+}
+
+func TestSanitizeMTU(t *testing.T) {
+	savedFamily, savedOverrides := podFamily, deviceRuleOverrides
+	defer func() {
+		podFamily, deviceRuleOverrides = savedFamily, savedOverrides
+	}()
+
+	tests := []struct {
+		name      string
+		podFamily string
+		mtu       int
+		overheads map[string]int
+		overrides map[string]deviceRule
+		tunnelMTU int
+		invalid   bool
+	}{
+		{name: "ipv4", podFamily: familyIPv4, mtu: 1500,
+			overheads: map[string]int{familyIPv4: 50}, tunnelMTU: 1450},
+		{name: "no tunnel", podFamily: familyIPv4, mtu: 1500,
+			overheads: map[string]int{familyIPv4: 0}, tunnelMTU: 1500},
+		{name: "dual stack underlay", podFamily: familyDual, mtu: 1500,
+			overheads: map[string]int{familyIPv4: 50, familyIPv6: 70}, tunnelMTU: 1430},
+		{name: "maximum", podFamily: familyIPv4, mtu: 65520,
+			overheads: map[string]int{familyIPv4: 50}, tunnelMTU: 65470},
+		{name: "above maximum", podFamily: familyIPv4, mtu: 65521,
+			overheads: map[string]int{familyIPv4: 50}, invalid: true},
+		{name: "ipv4 tunnel minimum", podFamily: familyIPv4, mtu: 626,
+			overheads: map[string]int{familyIPv4: 50}, tunnelMTU: 576},
+		{name: "ipv4 tunnel below minimum", podFamily: familyIPv4, mtu: 625,
+			overheads: map[string]int{familyIPv4: 50}, invalid: true},
+		{name: "ipv6 tunnel minimum", podFamily: familyIPv6, mtu: 1330,
+			overheads: map[string]int{familyIPv4: 50}, tunnelMTU: 1280},
+		{name: "ipv6 tunnel below minimum", podFamily: familyIPv6, mtu: 1329,
+			overheads: map[string]int{familyIPv4: 50}, invalid: true},
+		{name: "ipv6 underlay below minimum", podFamily: familyIPv4, mtu: 1200,
+			overheads: map[string]int{familyIPv6: 0}, invalid: true},
+		{name: "dual stack tunnel valid for ipv4 only", podFamily: familyDual, mtu: 1300,
+			overheads: map[string]int{familyIPv4: 50}, invalid: true},
+		{name: "ipv4 pods with tunnel below ipv6 minimum", podFamily: familyIPv4,
+			mtu: 1300, overheads: map[string]int{familyIPv4: 50}, tunnelMTU: 1250},
+		{name: "negative overhead", podFamily: familyIPv4, mtu: 1500,
+			overheads: map[string]int{familyIPv4: -1}, invalid: true},
+		{name: "fixed rule below minimum", podFamily: familyIPv6, mtu: 1500,
+			overheads: map[string]int{familyIPv4: 50},
+			overrides: map[string]deviceRule{"cilium_host": {kind: ruleFixed, mtu: 1000}},
+			invalid:   true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			podFamily = tt.podFamily
+			deviceRuleOverrides = tt.overrides
+			mtu, tunnelMTU, err := sanitizeMTU(tt.mtu, tt.overheads)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("device MTU %d and tunnel MTU %d accepted, expected an error",
+						mtu, tunnelMTU)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("device MTU %d rejected: %s", tt.mtu, err)
+			}
+			if mtu != tt.mtu {
+				t.Errorf("device MTU is %d, expected %d", mtu, tt.mtu)
+			}
+			if tunnelMTU != tt.tunnelMTU {
+				t.Errorf("tunnel MTU is %d, expected %d", tunnelMTU, tt.tunnelMTU)
+			}
+		})
+	}
+}
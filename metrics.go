@@ -0,0 +1,220 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsNamespace = "mtu_update"
+
+	resultUpdated = "updated"
+	resultSkipped = "skipped"
+	resultFailed  = "failed"
+
+	passFull        = "full"
+	passIncremental = "incremental"
+)
+
+var (
+	// durationBuckets are the upper bounds in seconds of the buckets of
+	// the run duration histogram.
+	durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+)
+
+// resultKey identifies a counter by the result of an update and the reason
+// for that result.
+type resultKey struct {
+	result string
+	reason string
+}
+
+// histogram is a minimal cumulative histogram using durationBuckets.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metricsRegistry tracks the results of MTU updates and exposes them in the
+// Prometheus text exposition format. A nil registry ignores all updates.
+type metricsRegistry struct {
+	mu sync.Mutex
+
+	namespaces map[resultKey]uint64
+	hostLinks  map[resultKey]uint64
+	durations  map[string]*histogram
+
+	deviceMTU       int
+	tunnelMTU       int
+	outOfCompliance int
+}
+
+func newMetricsRegistry(deviceMTU, tunnelMTU int) *metricsRegistry {
+	return &metricsRegistry{
+		namespaces: make(map[resultKey]uint64),
+		hostLinks:  make(map[resultKey]uint64),
+		durations:  make(map[string]*histogram),
+		deviceMTU:  deviceMTU,
+		tunnelMTU:  tunnelMTU,
+	}
+}
+
+// reasonLabel converts a human-readable skip reason into a label value.
+func reasonLabel(reason string) string {
+	return strings.Replace(strings.ToLower(reason), " ", "_", -1)
+}
+
+// resultOf classifies the outcome of an update for use in the counters.
+func resultOf(changed bool, skipped, err string) resultKey {
+	switch {
+	case err != "":
+		return resultKey{result: resultFailed, reason: "error"}
+	case changed:
+		return resultKey{result: resultUpdated}
+	}
+	return resultKey{result: resultSkipped, reason: reasonLabel(skipped)}
+}
+
+// observe updates the metrics with the outcome of a pass of the specified
+// kind, which took 'duration'. Full passes also update the number of
+// namespaces which are out of compliance.
+func (m *metricsRegistry) observe(kind string, rep *report, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	outOfCompliance := 0
+	for _, nsr := range rep.Namespaces {
+		m.namespaces[resultOf(nsr.changed(), nsr.Skipped, nsr.Error)]++
+		if nsr.Managed && !nsr.done() {
+			outOfCompliance++
+		}
+	}
+	for _, lr := range rep.HostLinks {
+		m.hostLinks[resultOf(lr.Change != nil && lr.Error == "", lr.Skipped, lr.Error)]++
+	}
+	if kind == passFull {
+		m.outOfCompliance = outOfCompliance
+	}
+
+	h, ok := m.durations[kind]
+	if !ok {
+		h = &histogram{}
+		m.durations[kind] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n", metricsNamespace, name, help)
+	fmt.Fprintf(w, "# TYPE %s_%s %s\n", metricsNamespace, name, kind)
+}
+
+func writeResults(w io.Writer, name, help string, counters map[resultKey]uint64) {
+	keys := make([]resultKey, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].result != keys[j].result {
+			return keys[i].result < keys[j].result
+		}
+		return keys[i].reason < keys[j].reason
+	})
+
+	writeHeader(w, name, "counter", help)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s_%s{result=%q,reason=%q} %d\n",
+			metricsNamespace, name, k.result, k.reason, counters[k])
+	}
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeResults(w, "namespaces_total",
+		"Number of namespaces processed, by result and reason.",
+		m.namespaces)
+	writeResults(w, "host_links_total",
+		"Number of host links processed, by result and reason.",
+		m.hostLinks)
+
+	kinds := make([]string, 0, len(m.durations))
+	for kind := range m.durations {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	writeHeader(w, "run_duration_seconds", "histogram",
+		"Duration of update passes, by kind of pass.")
+	for _, kind := range kinds {
+		h := m.durations[kind]
+		name := metricsNamespace + "_run_duration_seconds"
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "%s_bucket{kind=%q,le=\"%g\"} %d\n",
+				name, kind, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{kind=%q,le=\"+Inf\"} %d\n",
+			name, kind, h.count)
+		fmt.Fprintf(w, "%s_sum{kind=%q} %g\n", name, kind, h.sum)
+		fmt.Fprintf(w, "%s_count{kind=%q} %d\n", name, kind, h.count)
+	}
+
+	writeHeader(w, "device_mtu", "gauge", "Configured device MTU.")
+	fmt.Fprintf(w, "%s_device_mtu %d\n", metricsNamespace, m.deviceMTU)
+	writeHeader(w, "tunnel_mtu", "gauge", "Configured tunnel MTU.")
+	fmt.Fprintf(w, "%s_tunnel_mtu %d\n", metricsNamespace, m.tunnelMTU)
+	writeHeader(w, "namespaces_out_of_compliance", "gauge",
+		"Number of managed namespaces without the desired MTU as of the last full pass.")
+	fmt.Fprintf(w, "%s_namespaces_out_of_compliance %d\n",
+		metricsNamespace, m.outOfCompliance)
+}
+
+// serveMetrics starts an HTTP server exposing the metrics on the specified
+// address in the background.
+func serveMetrics(address string, m *metricsRegistry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		log.WithError(err).Error("Metrics server stopped")
+	}()
+}
@@ -16,11 +16,17 @@ package main
 
 import (
 	"fmt"
-	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
 // inodeFromHandle gets a unique identifier (in the form of the inode) from a
@@ -34,176 +40,617 @@ func inodeFromHandle(nsHandle netns.NsHandle) (uint64, error) {
 	return statInfo.Ino, nil
 }
 
-// scanNamespaces finds a list of all network namespaces reachable from the
-// current namespace. Returns a handle to the current namespace and a slice of
-// child namespace handles which does not include the current namespace.
+// namespace describes a network namespace found while scanning the system.
 //
-// The caller must eventually call Close() on every NsHandle returned here.
-func scanNamespaces() (netns.NsHandle, []netns.NsHandle, error) {
-	log.Debug("Fetching list of network namespaces")
+// Rather than moving the calling thread into the namespace, all netlink
+// requests are made through a handle bound to the namespace. This allows
+// several namespaces to be updated concurrently, and guarantees that the
+// calling thread always remains in the host namespace.
+type namespace struct {
+	handle netns.NsHandle
+	inode  uint64
+	pids   []int
 
-	rootNS, err := netns.Get()
-	if err != nil {
-		return netns.None(), nil, err
+	// sources describes how the namespace was found, see nsRef.
+	sources []string
+
+	// nl is a netlink handle bound to the namespace. It is only valid
+	// after openNetlink() has been called.
+	nl *netlink.Handle
+
+	// log is a logger scoped to the namespace.
+	log *logrus.Entry
+}
+
+func newNamespace(nsHandle netns.NsHandle, inode uint64) *namespace {
+	return &namespace{
+		handle: nsHandle,
+		inode:  inode,
+		log:    log.WithField("netns", inode),
 	}
+}
 
-	rootInode, err := inodeFromHandle(rootNS)
+// openNetlink opens a netlink handle bound to the namespace.
+func (ns *namespace) openNetlink() error {
+	if ns.nl != nil {
+		return nil
+	}
+	nl, err := netlink.NewHandleAt(ns.handle, unix.NETLINK_ROUTE)
 	if err != nil {
-		return netns.None(), nil,
-			fmt.Errorf("Failed to get host netns: %s", err)
+		return fmt.Errorf("failed to open netlink handle: %s", err)
 	}
+	ns.nl = nl
+	return nil
+}
 
-	paths, err := filepath.Glob("/proc/*/ns/net")
+// socket creates a socket in the namespace, see do(). The returned socket
+// remains bound to the namespace regardless of which thread uses it.
+func (ns *namespace) socket(domain, typ, proto int) (int, error) {
+	fd := -1
+	err := ns.do(func() error {
+		var err error
+		fd, err = unix.Socket(domain, typ, proto)
+		return err
+	})
 	if err != nil {
-		return netns.None(), nil, err
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+		return -1, err
 	}
+	return fd, nil
+}
 
-	// Use a map as a set so each netns is only found once.
-	namespaces := make(map[uint64]netns.NsHandle)
-	for _, path := range paths {
-		nsHandle, err := netns.GetFromPath(path)
+// do runs 'fn' in the namespace, so that sockets created and processes
+// started by 'fn' belong to the namespace. 'fn' runs on a dedicated
+// goroutine locked to its thread, which is moved into the namespace only
+// for as long as 'fn' runs. If the thread cannot return to the original
+// namespace, the goroutine exits with the thread still locked, so that the
+// runtime terminates the thread rather than reusing it in the wrong
+// namespace.
+func (ns *namespace) do(fn func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := netns.Get()
 		if err != nil {
-			log.WithError(err).WithField("path", path).Warn(
-				"Failed to fetch netns")
-			continue
+			runtime.UnlockOSThread()
+			result <- err
+			return
+		}
+		defer origin.Close()
+
+		if err := netns.Set(ns.handle); err != nil {
+			runtime.UnlockOSThread()
+			result <- err
+			return
+		}
+		fnErr := fn()
+		if err := netns.Set(origin); err != nil {
+			result <- fmt.Errorf("failed to return to netns: %s", err)
+			return
+		}
+		runtime.UnlockOSThread()
+		result <- fnErr
+	}()
+	return <-result
+}
+
+// Close releases the netlink handle and the namespace handle.
+func (ns *namespace) Close() {
+	if ns.nl != nil {
+		ns.nl.Delete()
+		ns.nl = nil
+	}
+	ns.handle.Close()
+}
+
+// isNetns returns true if the handle refers to a namespace, rather than eg
+// a file left behind after a bind mount was removed.
+func isNetns(nsHandle netns.NsHandle) bool {
+	var statfs unix.Statfs_t
+	if err := unix.Fstatfs(int(nsHandle), &statfs); err != nil {
+		return false
+	}
+	return statfs.Type == nsfsMagic
+}
+
+// addSource records that the namespace was found through 'source'.
+func (ns *namespace) addSource(source string) {
+	for _, s := range ns.sources {
+		if s == source {
+			return
 		}
+	}
+	ns.sources = append(ns.sources, source)
+}
+
+// pidFromPath extracts the PID from a path of the form /proc/<pid>/ns/net.
+// Returns 0 if the path does not contain a PID.
+func pidFromPath(path string) int {
+	elems := strings.Split(path, "/")
+	if len(elems) < 3 {
+		return 0
+	}
+	pid, err := strconv.Atoi(elems[2])
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// currentNamespace returns a description of the current network namespace,
+// with a netlink handle opened for it.
+//
+// The caller must eventually call Close() on the returned namespace.
+func currentNamespace() (*namespace, error) {
+	nsHandle, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	inode, err := inodeFromHandle(nsHandle)
+	if err != nil {
+		nsHandle.Close()
+		return nil, err
+	}
+
+	ns := newNamespace(nsHandle, inode)
+	if err := ns.openNetlink(); err != nil {
+		ns.Close()
+		return nil, err
+	}
+	return ns, nil
+}
+
+// scanNamespaces finds a list of all network namespaces reachable from the
+// current namespace through the configured discovery sources. Returns the
+// current namespace and a slice of child namespaces which does not include
+// the current namespace, sorted by inode.
+//
+// The caller must eventually call Close() on every namespace returned here.
+func scanNamespaces() (*namespace, []*namespace, error) {
+	log.Debug("Fetching list of network namespaces")
+
+	sources, err := newNSSources(netnsSources, netnsDirs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rootNS, err := currentNamespace()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to get host netns: %s", err)
+	}
 
-		inode, err := inodeFromHandle(nsHandle)
+	// Use a map as a set so each netns is only found once.
+	namespaces := make(map[uint64]*namespace)
+	for _, source := range sources {
+		refs, err := source.Scan()
 		if err != nil {
-			log.WithError(err).WithField("path", path).Warn(
-				"Failed to get netns inode")
+			log.WithError(err).WithField("source", source.Name()).Warn(
+				"Failed to scan for netns")
 			continue
 		}
-
-		if _, ok := namespaces[inode]; ok {
-			// If duplicate, close this copy of the open nsHandle.
-			nsHandle.Close()
-		} else {
-			namespaces[inode] = nsHandle
+		for _, ref := range refs {
+			addNamespaceRef(namespaces, ref)
 		}
 	}
-	delete(namespaces, rootInode)
+	if ns, ok := namespaces[rootNS.inode]; ok {
+		ns.Close()
+		delete(namespaces, rootNS.inode)
+	}
 
 	// Convert the map to an easily iterable slice.
-	result := make([]netns.NsHandle, 0, len(namespaces))
-	for _, nsHandle := range namespaces {
-		result = append(result, nsHandle)
+	result := make([]*namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		sort.Ints(ns.pids)
+		ns.log.WithField("source", strings.Join(ns.sources, ", ")).Debug(
+			"Found netns")
+		result = append(result, ns)
 	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].inode < result[j].inode
+	})
 
 	return rootNS, result, nil
 }
 
-// updateNamespaceMTU attempts to update the MTU of routes and links within
-// the current namespace, and returns true if the MTU was updated.
-// Returns false if the update was skipped or unsuccessful.
-func updateNamespaceMTU(deviceMTU, tunnelMTU int, epInfo *endpointInfo) (bool, error) {
-	managed := false
-	link, err := getPrimaryLink()
+// addNamespaceRef opens the namespace referenced by 'ref' and adds it to
+// 'namespaces', unless a namespace with the same inode was already found.
+// In either case, the PID and source of the reference are recorded.
+func addNamespaceRef(namespaces map[uint64]*namespace, ref nsRef) {
+	scopedLog := log.WithFields(logrus.Fields{
+		"path":   ref.path,
+		"source": ref.source,
+	})
+
+	nsHandle, err := netns.GetFromPath(ref.path)
+	if err != nil {
+		// Processes may exit while scanning, so only complain about
+		// namespaces which were explicitly bind-mounted.
+		if ref.pid == 0 && ref.source != sourceFD {
+			scopedLog.WithError(err).Warn("Failed to fetch netns")
+		} else {
+			scopedLog.WithError(err).Debug("Failed to fetch netns")
+		}
+		return
+	}
+
+	inode, err := inodeFromHandle(nsHandle)
 	if err != nil {
-		return false, fmt.Errorf("Failed to find primary link: %s", err)
+		scopedLog.WithError(err).Warn("Failed to get netns inode")
+		nsHandle.Close()
+		return
 	}
-	scopedLog.Debugf("Determining whether the link %s is managed",
+
+	ns, ok := namespaces[inode]
+	if ok {
+		// If duplicate, close this copy of the open nsHandle.
+		nsHandle.Close()
+	} else {
+		if !isNetns(nsHandle) {
+			scopedLog.Debug("Not a netns, skipping")
+			nsHandle.Close()
+			return
+		}
+		ns = newNamespace(nsHandle, inode)
+		namespaces[inode] = ns
+	}
+	if ref.pid != 0 {
+		ns.pids = append(ns.pids, ref.pid)
+	}
+	ns.addSource(ref.source)
+}
+
+// matchPodLink determines whether the pod link is managed by Cilium, first
+// by its addresses of the enabled families and then, for links which come in
+// pairs, by the name of its host side 'peer', which is the interface name of
+// the endpoint. 'peer' is nil if the link has no verified host side. Returns
+// the ID of the matching endpoint, and whether one was found. If not found,
+// the reason is recorded in 'plr'.
+func matchPodLink(ns *namespace, link *linkInfo, peer netlink.Link, epInfo *endpointInfo,
+	plr *podLinkReport) (int64, bool) {
+	mismatch := false
+	ns.log.Debugf("Determining whether the link %s is managed",
 		link.Attrs().Name)
 	for _, addr := range link.Addrs {
-		scopedLog.Debugf("  Looking at address %s", addr)
-		if epInfo.managedIP(addr.IP) {
-			managed = true
-			break
+		plr.Addresses = append(plr.Addresses, addr.IPNet.String())
+	}
+	for _, addr := range link.Addrs {
+		ns.log.Debugf("  Looking at address %s", addr)
+		id, ok := epInfo.lookupIP(addr.IP)
+		if !ok {
+			continue
+		}
+		if !familyEnabled(ipFamily(addr.IP)) {
+			ns.log.Debugf("  Address family of %s not enabled", addr)
+			mismatch = true
+			continue
+		}
+		return id, true
+	}
+	if peer != nil && !mismatch {
+		if id, ok := epInfo.lookupLink(peer.Attrs().Name); ok {
+			return id, true
 		}
 	}
 
-	// Skip if Cilium doesn't manage the addresses or the MTU is correct.
+	if mismatch {
+		ns.log.Debugf("Only addrs of disabled families match in link %+v, skipping", link)
+		plr.Skipped = skipFamilyMismatch
+	} else {
+		ns.log.Debugf("No match for addrs in link %+v, skipping", link)
+		plr.Skipped = skipNotManaged
+	}
+	return 0, false
+}
+
+// updatePodLinkMTU attempts to update the MTU of the pod link and its routes
+// within the namespace 'ns', along with the host side of the pair for links
+// which come in pairs, and returns true if the MTU was updated. Returns false
+// if the update was skipped or unsuccessful. The changes made in 'ns' are
+// recorded in 'nsr', and the change of the host side and the reason for
+// skipping the link in 'plr'.
+//
+// The pair is only updated if the host side is verified to be the peer of
+// the pod link, see hostPeers.lookup(). The routes, the pod link and its
+// peer are updated in the order described in order.go. If 'p' is not nil,
+// the changes are only planned and checked by the preflight.
+func updatePodLinkMTU(ns *namespace, link *linkInfo, deviceMTU, tunnelMTU int,
+	epInfo *endpointInfo, peers *hostPeers, nsr *nsReport, plr *podLinkReport, p *preflight) (bool, error) {
+	// The host side is looked up first, as links may be matched by it.
+	var (
+		peer    netlink.Link
+		peerErr error
+	)
+	if isPairLinkType(link.Type()) {
+		peer, peerErr = peers.lookup(ns, link.Link)
+	}
+
+	// Skip if Cilium doesn't manage the link.
+	id, managed := matchPodLink(ns, link, peer, epInfo, plr)
 	if !managed {
-		scopedLog.Debugf("No match for addrs in link %+v, skipping", link)
 		return false, nil
 	}
-	if link.Attrs().MTU == deviceMTU {
-		scopedLog.Debugf("Device MTU matches desired MTU, skipping")
-		return false, nil
+	plr.Endpoint = id
+	nsr.Managed = true
+
+	if peerErr != nil {
+		return false, fmt.Errorf("Failed to find host peer: %s", peerErr)
 	}
+	if peer != nil {
+		plr.Peer = peer.Attrs().Name
+		plr.PeerIfindex = peer.Attrs().Index
+	}
+
+	// The routes are checked even if both links match the device MTU, as
+	// the MTU of remote routes also follows the tunnel MTU.
+	podMatches := link.Attrs().MTU == deviceMTU
+	peerMatches := peer == nil || peer.Attrs().MTU == deviceMTU
 
-	// Update routes
-	routes, err := getDefaultRoutes()
-	if err != nil || len(routes) < 1 {
+	// Links other than the primary one may have no routes of their own.
+	routes, err := getRoutes(ns, link.Link)
+	if err != nil {
 		return false, fmt.Errorf("Failed to fetch routes: %s", err)
 	}
-	for _, r := range routes {
-		r.MTU = tunnelMTU
-		err = netlink.RouteReplace(&r)
-		if err == nil {
-			log.WithField("route", r).Debugf("Updated MTU")
-		} else {
-			return false, fmt.Errorf(
-				"Failed to set route MTU for %s: %s", r, err)
+	var locked map[string]bool
+	if lockRouteMTU {
+		locked, err = getLockedRoutes(ns, netlinkFamily())
+		if err != nil {
+			return false, fmt.Errorf("Failed to fetch route locks: %s", err)
 		}
 	}
 
-	// Update link
-	err = netlink.LinkSetMTU(link.Link, deviceMTU)
+	// Apply the changes in a safe order, see order.go.
+	changes := len(nsr.Changes)
+	podShrinks := shrinks(link.Attrs().MTU, deviceMTU)
+	peerShrinks := peer != nil && shrinks(peer.Attrs().MTU, deviceMTU)
+	err = updatePodRoutesMTU(ns, link, routes, locked, true, deviceMTU,
+		tunnelMTU, epInfo, nsr, p)
+	if err == nil && !podMatches && podShrinks {
+		err = updatePodSideMTU(ns, link, deviceMTU, nsr, p)
+	}
+	if err == nil && !peerMatches && peerShrinks {
+		err = updateHostPeerMTU(ns, peer, deviceMTU, peers, plr, p)
+	}
+	if err == nil && !peerMatches && !peerShrinks {
+		err = updateHostPeerMTU(ns, peer, deviceMTU, peers, plr, p)
+	}
+	if err == nil && !podMatches && !podShrinks {
+		err = updatePodSideMTU(ns, link, deviceMTU, nsr, p)
+	}
 	if err == nil {
-		log.WithField("link", link.Link.Attrs().Name).Debugf("Updated MTU")
-	} else {
-		return false, fmt.Errorf("Failed to set link MTU for %s: %s",
-			link.Attrs().Name, err)
+		err = updatePodRoutesMTU(ns, link, routes, locked, false, deviceMTU,
+			tunnelMTU, epInfo, nsr, p)
+	}
+	if err != nil {
+		return false, err
 	}
 
+	if len(nsr.Changes) == changes && plr.PeerChange == nil {
+		ns.log.Debugf("MTU of %s and its routes match, skipping",
+			link.Attrs().Name)
+		plr.Skipped = skipMTUMatches
+		return false, nil
+	}
 	return true, nil
 }
 
-// updateNamespaces searches for unique namespaces in the current namespace,
-// and attempts to update the device and route MTU in those namespaces if
-// their primary device IPs can be found in 'epInfo'.
-//
-// Returns the number of namespaces that were not updated as the first result.
-// Returns an error only if an error occurs while fetching namespaces.
-func updateNamespaces(deviceMTU, tunnelMTU int, epInfo *endpointInfo) (int, error) {
-	var (
-		skipped int
-		failed  int
-		updated int
-	)
+// updatePodRoutesMTU updates the MTU of the routes via the pod link 'link'
+// in namespace 'ns' whose MTU shrinks if 'shrinking' is true, or grows
+// otherwise. Routes whose MTU is unchanged but whose advertised MSS or MTU
+// lock differ are updated with the growing routes. 'locked' holds the keys
+// of the routes whose MTU is locked. The changes made are recorded in 'nsr'.
+func updatePodRoutesMTU(ns *namespace, link *linkInfo, routes []familyRoute, locked map[string]bool,
+	shrinking bool, deviceMTU, tunnelMTU int, epInfo *endpointInfo, nsr *nsReport, p *preflight) error {
+	for _, r := range routes {
+		class := classifyRoute(&r.Route, epInfo)
+		mtu := routeClassMTU(class, deviceMTU, tunnelMTU)
+		advmss, lock := routeTarget(&r, mtu)
+		isLocked := locked[routeKey(&r.Route)]
+		if r.MTU == mtu && r.AdvMSS == advmss && (!lock || isLocked) {
+			if shrinking {
+				ns.log.WithField("route", routeString(&r.Route)).Debugf(
+					"Route MTU matches desired MTU, skipping")
+			}
+			continue
+		}
+		if shrinks(routeEffectiveMTU(&r.Route, link.Attrs().MTU), mtu) != shrinking {
+			continue
+		}
+		c, err := setRouteMTU(ns, r, link.Attrs().Name, class, mtu, isLocked, p)
+		nsr.Changes = append(nsr.Changes, c)
+		if err != nil {
+			return fmt.Errorf("Failed to set route MTU for %s: %s",
+				c.Route, err)
+		}
+		ns.log.WithField("route", c.Route).Debugf("Updated MTU")
+	}
+	return nil
+}
 
-	rootNamespace, namespaces, err := scanNamespaces()
+// updatePodSideMTU sets the MTU of the pod link 'link' in namespace 'ns',
+// and records the change in 'nsr'.
+func updatePodSideMTU(ns *namespace, link *linkInfo, deviceMTU int, nsr *nsReport, p *preflight) error {
+	c, err := setLinkMTU(ns, link.Link, deviceMTU, p)
+	nsr.Changes = append(nsr.Changes, c)
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("Failed to set link MTU for %s: %s",
+			link.Attrs().Name, err)
 	}
+	ns.log.WithField("link", link.Attrs().Name).Debugf("Updated MTU")
+	return nil
+}
 
-	// Set routes and device MTUs inside the network namespaces
-	for _, nsHandle := range namespaces {
-		log.Debugf("Moving to netns %d", nsHandle)
-		scopedLog = log.WithField("netns", nsHandle)
+// updateHostPeerMTU sets the MTU of the host side 'peer' of a pod link in
+// namespace 'ns', and records the change in 'plr'.
+func updateHostPeerMTU(ns *namespace, peer netlink.Link, deviceMTU int,
+	peers *hostPeers, plr *podLinkReport, p *preflight) error {
+	c, err := peers.setMTU(peer, deviceMTU, p)
+	plr.PeerChange = c
+	if err != nil {
+		return fmt.Errorf("Failed to set link MTU for host peer %s: %s",
+			peer.Attrs().Name, err)
+	}
+	ns.log.WithField("peer", peer.Attrs().Name).Debugf("Updated MTU")
+	return nil
+}
 
-		err = netns.Set(nsHandle)
+// updateNamespaceMTU attempts to update the MTU of routes and links of every
+// managed pod link within the namespace 'ns', and returns true if the MTU of
+// any of them was updated. Each link is updated independently, so a failure
+// on one link does not prevent the others from being updated. The changes
+// made are recorded in 'nsr', along with the reason for skipping each link
+// or the namespace as a whole. If 'p' is not nil, the changes are only
+// planned and checked by the preflight.
+func updateNamespaceMTU(ns *namespace, deviceMTU, tunnelMTU int, epInfo *endpointInfo,
+	peers *hostPeers, nsr *nsReport, p *preflight) (bool, error) {
+	links, err := getPodLinks(ns)
+	if err != nil {
+		return false, fmt.Errorf("Failed to find pod links: %s", err)
+	}
+	if len(links) == 0 {
+		ns.log.Debugf("No links of type %s, skipping",
+			strings.Join(podLinkTypes, ", "))
+		nsr.Skipped = skipNoPodLinks
+		return false, nil
+	}
+
+	updated := false
+	mismatch := false
+	failures := []string{}
+	for _, link := range links {
+		plr := nsr.addLink(link.Link)
+		ok, err := updatePodLinkMTU(ns, link, deviceMTU, tunnelMTU,
+			epInfo, peers, nsr, plr, p)
 		if err != nil {
-			failed++
-			log.WithError(err).Warn("Failed to set netns")
+			plr.Error = err.Error()
+			failures = append(failures, fmt.Sprintf("%s: %s",
+				plr.Name, err))
+			continue
+		}
+		updated = updated || ok
+		mismatch = mismatch || plr.Skipped == skipFamilyMismatch
+	}
+
+	if nsr.Managed && clampEnabled(clampPod) {
+		changes := len(nsr.Changes)
+		if err := updatePodClamp(ns, tunnelMTU, nsr, p); err != nil {
+			failures = append(failures, err.Error())
+		}
+		updated = updated || len(nsr.Changes) > changes
+	}
+
+	switch {
+	case len(failures) > 0:
+		return updated, fmt.Errorf("%s", strings.Join(failures, "; "))
+	case !nsr.Managed && mismatch:
+		nsr.Skipped = skipFamilyMismatch
+	case !nsr.Managed:
+		nsr.Skipped = skipNotManaged
+	case !updated:
+		nsr.Skipped = skipMTUMatches
+	}
+
+	return updated, nil
+}
+
+// updateNamespaceWorker updates each namespace received from 'work' until
+// the channel is closed, recording the outcome in the corresponding entry
+// of 'reports'.
+func updateNamespaceWorker(work <-chan int, namespaces []*namespace,
+	reports []*nsReport, deviceMTU, tunnelMTU int, epInfo *endpointInfo,
+	peers *hostPeers, p *preflight) {
+	for i := range work {
+		ns, nsr := namespaces[i], reports[i]
+
+		if err := ns.openNetlink(); err != nil {
+			nsr.Error = err.Error()
+			ns.log.WithError(err).Warn("Failed to enter netns")
 			continue
 		}
 
-		ok, err := updateNamespaceMTU(deviceMTU, tunnelMTU, epInfo)
+		ok, err := updateNamespaceMTU(ns, deviceMTU, tunnelMTU, epInfo,
+			peers, nsr, p)
 		if err != nil {
-			failed++
-			scopedLog.WithError(err).Warn("Failed to update MTU")
+			nsr.Error = err.Error()
+			ns.log.WithError(err).Warn("Failed to update MTU")
 			continue
 		}
 
-		if ok {
+		if ok && verify && !dryRun && p == nil {
+			err := verifyNamespace(ns, deviceMTU, tunnelMTU, epInfo, nsr)
+			if err != nil {
+				nsr.Error = fmt.Sprintf("verification failed: %s", err)
+				ns.log.WithError(err).Warn("Failed to verify MTU")
+			}
+		}
+	}
+}
+
+// updateNamespaceList attempts to update the device and route MTU in each of
+// the specified namespaces if their pod link IPs can be found in 'epInfo',
+// along with the host side of the pod links found in 'peers'. Up to
+// 'parallelism' namespaces are updated concurrently. The outcome for each
+// namespace is recorded in 'rep', in the order in which the namespaces were
+// specified. If 'p' is not nil, the changes are only planned and checked by
+// the preflight.
+//
+// Returns the number of namespaces that were not updated.
+func updateNamespaceList(namespaces []*namespace, deviceMTU, tunnelMTU int,
+	epInfo *endpointInfo, peers *hostPeers, rep *report, p *preflight) int {
+	var (
+		skipped int
+		failed  int
+		updated int
+	)
+
+	reports := make([]*nsReport, 0, len(namespaces))
+	for _, ns := range namespaces {
+		reports = append(reports, rep.addNamespace(ns.inode, ns.pids,
+			ns.sources))
+	}
+
+	// Set routes and device MTUs inside the network namespaces
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			updateNamespaceWorker(work, namespaces, reports,
+				deviceMTU, tunnelMTU, epInfo, peers, p)
+		}()
+	}
+	for i := range namespaces {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	for _, nsr := range reports {
+		switch {
+		case nsr.Error != "":
+			failed++
+		case nsr.changed():
 			updated++
-		} else {
+		default:
 			skipped++
 		}
 	}
 
-	// Return from whence we came, and clean up after ourselves.
-	log.Debugf("Moving to netns %d", rootNamespace)
-	netns.Set(rootNamespace)
-	rootNamespace.Close()
-	for _, nsHandle := range namespaces {
-		nsHandle.Close()
-	}
+	logSummary(p, "%s %d/%d namespaces, %d skipped, %d failed",
+		updatedVerb(p), updated, len(namespaces), skipped, failed)
 
-	log.Infof("Updated %d/%d namespaces, %d skipped, %d failed",
-		updated, len(namespaces), skipped, failed)
+	return failed
+}
 
-	return failed, nil
+// closeNamespaces closes the root namespace and all of the specified
+// namespaces.
+func closeNamespaces(rootNamespace *namespace, namespaces []*namespace) {
+	rootNamespace.Close()
+	for _, ns := range namespaces {
+		ns.Close()
+	}
 }
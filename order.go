@@ -0,0 +1,107 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+// Links drop packets which exceed their MTU, so while the MTU is changing
+// the sender of a packet must never be allowed to send more than the
+// receiver accepts. The changes are therefore applied in this order:
+//
+// When the MTU increases, receivers are raised before senders:
+//   1. In each pod namespace, the host side of each pod link, then the pod
+//      side, and finally the routes via the pod link.
+//   2. The cilium devices in the host namespace, which transmit towards the
+//      pods.
+//
+// When the MTU decreases, senders are lowered before receivers:
+//   1. The cilium devices in the host namespace.
+//   2. In each pod namespace, the routes via each pod link, then the pod
+//      side of the link, and finally the host side.
+//
+// The direction is determined separately for every link and route, so when
+// some MTUs increase while others decrease (eg the device MTU grows while
+// the tunnel MTU shrinks, or links were left at different MTUs by an earlier
+// run), every decrease in a step is applied before the increases.
+
+// shrinks returns true if changing the MTU from 'old' to 'new' decreases it.
+func shrinks(old, new int) bool {
+	return new < old
+}
+
+// routeEffectiveMTU returns the MTU used for the route, which is the MTU of
+// its link 'linkMTU' unless the route has its own MTU.
+func routeEffectiveMTU(route *netlink.Route, linkMTU int) int {
+	if route.MTU != 0 {
+		return route.MTU
+	}
+	return linkMTU
+}
+
+// applyHostUpdates applies the pending changes of host links in 'updates'
+// which shrink the MTU if 'shrinking' is true, or grow it otherwise. The
+// outcome is recorded in the report of each link.
+func applyHostUpdates(host *namespace, updates []hostUpdate, shrinking bool, p *preflight) {
+	for _, u := range updates {
+		if shrinks(u.link.Attrs().MTU, u.mtu) == shrinking {
+			updateHostLink(host, u.link, u.mtu, u.lr, p)
+		}
+	}
+}
+
+// updateLinks updates the MTU of the pod namespaces by calling
+// 'updateNamespaces', and of the links 'allLinks' in the host namespace
+// 'host', in the order described above. If 'p' is not nil, the changes are
+// only planned and checked by the preflight. The outcome is recorded in
+// 'rep'.
+//
+// If 'updateNamespaces' returns an error, the host links whose MTU grows are
+// left alone, as they would transmit more than the pods accept, but the
+// outcome of the host links which shrank is still recorded.
+//
+// Returns the number of namespaces and host links which failed to be
+// updated, and an error only if 'updateNamespaces' returns one.
+func updateLinks(host *namespace, allLinks []netlink.Link, deviceMTU, tunnelMTU int,
+	rep *report, p *preflight, updateNamespaces func() (int, error)) (int, error) {
+	log.Debug("Updating host namespace devices")
+	updates := planHostLinks(allLinks, deviceMTU, tunnelMTU, rep)
+
+	// First, shrink the cilium devices to stop transmitting larger MTU.
+	applyHostUpdates(host, updates, true, p)
+
+	failed, err := updateNamespaces()
+	recordHostPeers(rep)
+
+	// Next, grow the cilium devices to allow transmit of larger MTU.
+	if err == nil {
+		applyHostUpdates(host, updates, false, p)
+	} else {
+		for _, u := range updates {
+			if !shrinks(u.link.Attrs().MTU, u.mtu) {
+				u.lr.Skipped = skipNamespacesFailed
+			}
+		}
+	}
+
+	logHostLinks(rep, p)
+	for _, u := range updates {
+		if u.lr.Error != "" {
+			failed++
+		}
+	}
+	return failed, err
+}
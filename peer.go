@@ -0,0 +1,144 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Attributes of RTM_GETNSID / RTM_NEWNSID messages, see
+	// <linux/net_namespace.h>.
+	netnsaNSID = 1
+	netnsaFD   = 3
+
+	// netnsidNotAssigned is reported for namespaces which have no ID in
+	// the requesting namespace.
+	netnsidNotAssigned = -1
+)
+
+// rtGenMsg is the header of RTM_GETNSID requests, padded to the netlink
+// alignment.
+type rtGenMsg struct {
+	family uint8
+}
+
+func (m *rtGenMsg) Len() int {
+	return unix.NLMSG_ALIGNTO
+}
+
+func (m *rtGenMsg) Serialize() []byte {
+	return []byte{m.family, 0, 0, 0}
+}
+
+// isPairLinkType returns true if links of the specified type come in pairs
+// with one end in the pod and the other in the host namespace.
+func isPairLinkType(linkType string) bool {
+	return linkType == "veth" || linkType == "netkit"
+}
+
+// netnsID returns the ID of the namespace 'ns' as seen from the namespace
+// of the calling thread, which is the ID reported in the link-netnsid of
+// links whose peer is in 'ns'.
+func netnsID(ns *namespace) (int, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETNSID, unix.NLM_F_REQUEST)
+	req.AddData(&rtGenMsg{family: unix.AF_UNSPEC})
+	req.AddData(nl.NewRtAttr(netnsaFD, nl.Uint32Attr(uint32(ns.handle))))
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWNSID)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range msgs {
+		if len(m) < unix.NLMSG_ALIGNTO {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[unix.NLMSG_ALIGNTO:])
+		if err != nil {
+			return 0, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == netnsaNSID && len(attr.Value) >= 4 {
+				return int(int32(nl.NativeEndian().Uint32(attr.Value))), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no netns ID in response")
+}
+
+// hostPeers indexes the links in the host namespace by ifindex, so that the
+// host side of pod links can be found from the pod side. It is safe for
+// concurrent use by the namespace workers.
+type hostPeers struct {
+	host  *namespace
+	links map[int]netlink.Link
+
+	// mu serializes the requests made through the netlink handle of
+	// the host namespace.
+	mu sync.Mutex
+}
+
+func newHostPeers(host *namespace, links []netlink.Link) *hostPeers {
+	result := &hostPeers{
+		host:  host,
+		links: make(map[int]netlink.Link, len(links)),
+	}
+	for _, link := range links {
+		result.links[link.Attrs().Index] = link
+	}
+	return result
+}
+
+// lookup returns the host side of the pod link 'link' in namespace 'ns'.
+// The pod link refers to its peer by ifindex, and the host link must refer
+// back to the pod link by ifindex and to 'ns' by netns ID for the two to be
+// the same pair. Returns an error if no such host link exists.
+func (p *hostPeers) lookup(ns *namespace, link netlink.Link) (netlink.Link, error) {
+	attrs := link.Attrs()
+	peer, ok := p.links[attrs.ParentIndex]
+	if !ok || peer.Type() != link.Type() {
+		return nil, fmt.Errorf("no host link with ifindex %d",
+			attrs.ParentIndex)
+	}
+	peerAttrs := peer.Attrs()
+	if peerAttrs.ParentIndex != attrs.Index {
+		return nil, fmt.Errorf("host link %s is paired with ifindex %d, not %d",
+			peerAttrs.Name, peerAttrs.ParentIndex, attrs.Index)
+	}
+
+	nsid, err := netnsID(ns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get netns ID: %s", err)
+	}
+	if nsid == netnsidNotAssigned || peerAttrs.NetNsID != nsid {
+		return nil, fmt.Errorf("host link %s is paired with a link in netns ID %d, not %d",
+			peerAttrs.Name, peerAttrs.NetNsID, nsid)
+	}
+
+	return peer, nil
+}
+
+// setMTU records a change of the MTU of the host link to 'mtu', and applies
+// it as in setLinkMTU().
+func (p *hostPeers) setMTU(link netlink.Link, mtu int, pf *preflight) (*change, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return setLinkMTU(p.host, link, mtu, pf)
+}
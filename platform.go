@@ -0,0 +1,241 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	platformAuto  = "auto"
+	platformGCP   = "gcp"
+	platformAWS   = "aws"
+	platformAzure = "azure"
+
+	// defaultMetadataEndpoint is the address of the instance metadata
+	// service, which is the same on all supported platforms.
+	defaultMetadataEndpoint = "http://169.254.169.254"
+
+	// metadataTimeout bounds each request to the metadata service, so
+	// that detection fails quickly off the cloud.
+	metadataTimeout = 2 * time.Second
+
+	// gcpDefaultMTU is the MTU of VPC networks created with the default
+	// settings.
+	gcpDefaultMTU = 1460
+
+	// awsJumboMTU is the MTU within a VPC on instances supporting jumbo
+	// frames, and awsStandardMTU on the others.
+	awsJumboMTU    = 9001
+	awsStandardMTU = 1500
+
+	// azureOverhead is taken by the Azure VNet, which fragments packets
+	// above 1400 bytes between instances with the default MTU of 1500.
+	azureOverhead = 100
+)
+
+// awsNonJumboFamilies are the previous generation instance families which
+// do not support jumbo frames. All current generation instances do.
+var awsNonJumboFamilies = map[string]bool{
+	"c1": true, "cc1": true, "cc2": true, "cg1": true, "cr1": true,
+	"hi1": true, "hs1": true, "m1": true, "m2": true, "t1": true,
+}
+
+// metadataClient queries the instance metadata service.
+type metadataClient struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newMetadataClient(endpoint string) *metadataClient {
+	return &metadataClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{Timeout: metadataTimeout},
+	}
+}
+
+// get sends a request with the specified headers to the metadata service,
+// and returns the body and headers of the response. Returns an error if the
+// response is not successful.
+func (c *metadataClient) get(method, path string, header map[string]string) (string, http.Header, error) {
+	req, err := http.NewRequest(method, c.endpoint+path, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.Header, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return strings.TrimSpace(string(data)), resp.Header, nil
+}
+
+// platformProfile describes how the base MTU is determined on a cloud
+// platform, and the overhead of its network.
+type platformProfile struct {
+	name string
+
+	// overhead is the number of bytes which the network of the platform
+	// takes from packets between instances, on top of the tunnel
+	// overhead of each underlay family.
+	overhead int
+
+	// detect returns true if the metadata service belongs to the
+	// platform.
+	detect func(c *metadataClient) bool
+
+	// mtu returns the base MTU of the instance and where it was taken
+	// from. It may return autodetectMTU, in which case the MTU is taken
+	// from the uplink device.
+	mtu func(c *metadataClient) (int, string)
+}
+
+var platformProfiles = []*platformProfile{
+	{name: platformGCP, detect: detectGCP, mtu: gcpMTU},
+	{name: platformAWS, detect: detectAWS, mtu: awsMTU},
+	{name: platformAzure, overhead: azureOverhead, detect: detectAzure, mtu: azureMTU},
+}
+
+// lookupPlatform returns the profile of the named platform, or nil for
+// platformAuto. Returns an error if the platform is unknown.
+func lookupPlatform(name string) (*platformProfile, error) {
+	if name == platformAuto {
+		return nil, nil
+	}
+	for _, p := range platformProfiles {
+		if p.name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown platform %q", name)
+}
+
+var gcpHeader = map[string]string{"Metadata-Flavor": "Google"}
+
+func detectGCP(c *metadataClient) bool {
+	_, header, err := c.get("GET", "/computeMetadata/v1/instance/id", gcpHeader)
+	return err == nil && header.Get("Metadata-Flavor") == "Google"
+}
+
+// gcpMTU returns the MTU of the VPC network of the primary interface, which
+// is configurable per network.
+func gcpMTU(c *metadataClient) (int, string) {
+	value, _, err := c.get("GET", "/computeMetadata/v1/instance/network-interfaces/0/mtu", gcpHeader)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to read VPC MTU, using the default of %d",
+			gcpDefaultMTU)
+		return gcpDefaultMTU, "VPC default"
+	}
+	mtu, err := strconv.Atoi(value)
+	if err != nil {
+		log.Warnf("Invalid VPC MTU %q, using the default of %d", value,
+			gcpDefaultMTU)
+		return gcpDefaultMTU, "VPC default"
+	}
+	return mtu, "VPC network MTU"
+}
+
+// awsInstanceType returns the instance type, using an IMDSv2 session token
+// if the metadata service issues one.
+func awsInstanceType(c *metadataClient) (string, error) {
+	header := map[string]string{}
+	token, _, err := c.get("PUT", "/latest/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err == nil {
+		header["X-aws-ec2-metadata-token"] = token
+	}
+	instanceType, _, err := c.get("GET", "/latest/meta-data/instance-type", header)
+	return instanceType, err
+}
+
+func detectAWS(c *metadataClient) bool {
+	_, err := awsInstanceType(c)
+	return err == nil
+}
+
+// awsMTU returns the jumbo frame MTU unless the instance type is known not
+// to support it.
+func awsMTU(c *metadataClient) (int, string) {
+	instanceType, err := awsInstanceType(c)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to read instance type, assuming jumbo frame support")
+		return awsJumboMTU, "jumbo frames"
+	}
+	family := strings.SplitN(instanceType, ".", 2)[0]
+	if awsNonJumboFamilies[family] {
+		return awsStandardMTU, fmt.Sprintf("instance type %s without jumbo frames", instanceType)
+	}
+	return awsJumboMTU, fmt.Sprintf("instance type %s with jumbo frames", instanceType)
+}
+
+func detectAzure(c *metadataClient) bool {
+	_, _, err := c.get("GET", "/metadata/instance/compute/vmSize?api-version=2021-02-01&format=text",
+		map[string]string{"Metadata": "true"})
+	return err == nil
+}
+
+// azureMTU returns autodetectMTU, as the MTU is configured per VNet and set
+// on the interfaces of the instance, but not reported by the metadata
+// service.
+func azureMTU(c *metadataClient) (int, string) {
+	return autodetectMTU, "VNet MTU of the uplink device"
+}
+
+// detectPlatform returns the profile of the named platform, detecting the
+// platform through the metadata service for platformAuto. Returns an error
+// if no platform is detected.
+func detectPlatform(name string, c *metadataClient) (*platformProfile, error) {
+	profile, err := lookupPlatform(name)
+	if err != nil || profile != nil {
+		return profile, err
+	}
+	for _, p := range platformProfiles {
+		log.Debugf("Checking for %s metadata service", p.name)
+		if p.detect(c) {
+			log.Infof("Detected platform %s", p.name)
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("no platform detected through metadata service %s",
+		c.endpoint)
+}
+
+// baseMTU returns the base MTU on the platform, or autodetectMTU if it is
+// to be taken from the uplink device.
+func (p *platformProfile) baseMTU(c *metadataClient) int {
+	mtu, source := p.mtu(c)
+	if mtu == autodetectMTU {
+		log.Infof("Platform %s uses the %s", p.name, source)
+	} else {
+		log.Infof("Platform %s uses base MTU %d from %s", p.name, mtu, source)
+	}
+	return mtu
+}
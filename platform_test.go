@@ -0,0 +1,241 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// newMetadataServer returns a stand-in for the metadata service of the
+// named platform, or of no platform if 'name' is empty. On GCP, the VPC
+// network MTU is 'gcpMTU' unless zero, and on AWS the instance type is
+// 'awsType'.
+func newMetadataServer(name string, gcpMTU int, awsType string) *httptest.Server {
+	mux := http.NewServeMux()
+	switch name {
+	case platformGCP:
+		mux.HandleFunc("/computeMetadata/v1/", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Metadata-Flavor", "Google")
+			switch r.URL.Path {
+			case "/computeMetadata/v1/instance/id":
+				fmt.Fprintln(w, "1234567890")
+			case "/computeMetadata/v1/instance/network-interfaces/0/mtu":
+				if gcpMTU == 0 {
+					http.NotFound(w, r)
+					return
+				}
+				fmt.Fprintln(w, gcpMTU)
+			default:
+				http.NotFound(w, r)
+			}
+		})
+	case platformAWS:
+		mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" {
+				http.Error(w, "", http.StatusMethodNotAllowed)
+				return
+			}
+			fmt.Fprint(w, "token")
+		})
+		mux.HandleFunc("/latest/meta-data/instance-type", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+				http.Error(w, "", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, awsType)
+		})
+	case platformAzure:
+		mux.HandleFunc("/metadata/instance/compute/vmSize", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Metadata") != "true" {
+				http.Error(w, "", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "Standard_D2s_v3")
+		})
+	}
+	return httptest.NewServer(mux)
+}
+
+func TestPlatformMTU(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   string
+		gcpMTU   int
+		awsType  string
+		platform string
+		detected string
+		mtu      int
+		overhead int
+	}{
+		{name: "gcp", server: platformGCP, gcpMTU: 8896, platform: platformAuto,
+			detected: platformGCP, mtu: 8896},
+		{name: "gcp without MTU", server: platformGCP, platform: platformGCP,
+			detected: platformGCP, mtu: gcpDefaultMTU},
+		{name: "aws jumbo", server: platformAWS, awsType: "m5.large",
+			platform: platformAuto, detected: platformAWS, mtu: awsJumboMTU},
+		{name: "aws previous generation", server: platformAWS, awsType: "m1.small",
+			platform: platformAuto, detected: platformAWS, mtu: awsStandardMTU},
+		{name: "azure", server: platformAzure, platform: platformAuto,
+			detected: platformAzure, mtu: autodetectMTU, overhead: azureOverhead},
+		{name: "none", platform: platformAuto},
+		{name: "unknown", platform: "openstack"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newMetadataServer(tt.server, tt.gcpMTU, tt.awsType)
+			defer server.Close()
+
+			profile, err := detectPlatform(tt.platform, newMetadataClient(server.URL))
+			if tt.detected == "" {
+				if err == nil {
+					t.Fatalf("detected platform %s, expected an error", profile.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to detect platform: %s", err)
+			}
+			if profile.name != tt.detected {
+				t.Errorf("detected platform %s, expected %s", profile.name, tt.detected)
+			}
+			if mtu := profile.baseMTU(newMetadataClient(server.URL)); mtu != tt.mtu {
+				t.Errorf("base MTU is %d, expected %d", mtu, tt.mtu)
+			}
+			if profile.overhead != tt.overhead {
+				t.Errorf("overhead is %d, expected %d", profile.overhead, tt.overhead)
+			}
+		})
+	}
+}
+
+func TestResolveBaseMTU(t *testing.T) {
+	server := newMetadataServer(platformAzure, 0, "")
+	defer server.Close()
+
+	savedMTU, savedDevice, savedPlatform, savedEndpoint := deviceMTU, uplinkDevice, platform, metadataEndpoint
+	savedSettings := configSettings
+	defer func() {
+		deviceMTU, uplinkDevice, platform, metadataEndpoint = savedMTU, savedDevice, savedPlatform, savedEndpoint
+		configSettings = savedSettings
+	}()
+
+	// The MTU autodetected from the uplink device.
+	const detectedMTU = 1400
+	detect := func() (int, error) {
+		return detectedMTU, nil
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		config   map[string]string
+		agentMTU int
+		force    bool
+		conflict bool
+		source   string
+		mtu      int
+		overhead int
+	}{
+		{name: "default", source: mtuFromDefault, mtu: 1500},
+		{name: "flag over platform", args: []string{"--mtu=9000", "--platform=azure"},
+			source: mtuFromFlag, mtu: 9000, overhead: azureOverhead},
+		{name: "flag contradicts agent", args: []string{"--mtu=9000"}, agentMTU: 1450,
+			conflict: true},
+		{name: "flag forced over agent", args: []string{"--mtu=9000"}, agentMTU: 1450,
+			force: true, source: mtuFromFlag, mtu: 9000},
+		{name: "autodetect flag gives way to agent", args: []string{"--mtu=0"}, agentMTU: 1450,
+			source: mtuFromAgent, mtu: 1450},
+		{name: "autodetect flag", args: []string{"--mtu=0"},
+			source: mtuFromFlag, mtu: detectedMTU},
+		{name: "platform contradicts agent", args: []string{"--platform=azure"}, agentMTU: 1450,
+			conflict: true},
+		{name: "platform forced over agent", args: []string{"--platform=azure"}, agentMTU: 1450,
+			force: true, source: mtuFromPlatform, mtu: detectedMTU, overhead: azureOverhead},
+		{name: "device contradicts agent", args: []string{"--device=eth0"}, agentMTU: 1450,
+			conflict: true},
+		{name: "device agrees with agent", args: []string{"--device=eth0"}, agentMTU: detectedMTU,
+			source: mtuFromDevice, mtu: detectedMTU},
+		{name: "device", args: []string{"--device=eth0"},
+			source: mtuFromDevice, mtu: detectedMTU},
+		{name: "platform", args: []string{"--platform=azure"},
+			source: mtuFromPlatform, mtu: detectedMTU, overhead: azureOverhead},
+		{name: "command line over config", args: []string{"--platform=azure"},
+			config: map[string]string{"mtu": "9000"},
+			source: mtuFromPlatform, mtu: detectedMTU, overhead: azureOverhead},
+		{name: "config", config: map[string]string{"device": "eth0"},
+			source: mtuFromDevice, mtu: detectedMTU},
+		{name: "config contradicts agent", config: map[string]string{"mtu": "9000"}, agentMTU: 1450,
+			conflict: true},
+		{name: "agent", agentMTU: 1450, source: mtuFromAgent, mtu: 1450},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			flags.IntVar(&deviceMTU, "mtu", 1500, "")
+			flags.StringVar(&uplinkDevice, "device", "", "")
+			flags.StringVar(&platform, "platform", "", "")
+			flags.StringVar(&metadataEndpoint, "metadata-endpoint", server.URL, "")
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			configSettings = map[string]bool{}
+			for name, value := range tt.config {
+				if err := flags.Set(name, value); err != nil {
+					t.Fatal(err)
+				}
+				configSettings[name] = true
+			}
+
+			var agent *agentConfig
+			if tt.agentMTU != 0 {
+				agent = &agentConfig{DeviceMTU: tt.agentMTU}
+			}
+
+			rep := newReport(0, 0)
+			overhead, err := resolveBaseMTU(flags, agent, tt.force, detect, rep)
+			if tt.conflict {
+				if err == nil {
+					t.Fatalf("resolved device MTU %d from %s, expected a conflict",
+						deviceMTU, rep.MTUSource)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to resolve base MTU: %s", err)
+			}
+			if rep.MTUSource != tt.source {
+				t.Errorf("MTU taken from %s, expected %s", rep.MTUSource, tt.source)
+			}
+			if deviceMTU != tt.mtu {
+				t.Errorf("device MTU is %d, expected %d", deviceMTU, tt.mtu)
+			}
+			if overhead != tt.overhead || rep.PlatformOverhead != tt.overhead {
+				t.Errorf("overhead is %d and %d in the report, expected %d",
+					overhead, rep.PlatformOverhead, tt.overhead)
+			}
+		})
+	}
+}
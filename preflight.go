@@ -0,0 +1,261 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// iflaMinMTU and iflaMaxMTU are the link attributes holding the MTU
+	// limits of the device, which are not known to the netlink library.
+	iflaMinMTU = 50
+	iflaMaxMTU = 51
+)
+
+// linkLimits describes the MTU limits of a link. minMTU and maxMTU are zero
+// if the kernel does not report them, or the device has no such limit.
+type linkLimits struct {
+	name   string
+	kind   string
+	mtu    int
+	minMTU int
+	maxMTU int
+
+	// lower is the ifindex of the lower device for link kinds which have
+	// one, and lowerNetnsID is the ID of the namespace it is in, if it is
+	// not in the namespace of the link.
+	lower        int
+	lowerNetnsID int
+}
+
+// hasLowerDevice returns true if links of the specified kind transmit
+// through a lower device, and cannot have a higher MTU than it.
+func hasLowerDevice(kind string) bool {
+	switch kind {
+	case "vlan", "macvlan", "macvtap", "ipvlan", "ipvtap":
+		return true
+	}
+	return false
+}
+
+// getLinkLimits returns the MTU limits of the link with the specified
+// ifindex in namespace 'ns'.
+func getLinkLimits(ns *namespace, ifindex int) (*linkLimits, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(ifindex)
+	req.AddData(msg)
+
+	msgs, err := ns.execute(req, unix.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+
+	native := nl.NativeEndian()
+	for _, m := range msgs {
+		info := nl.DeserializeIfInfomsg(m)
+		if int(info.Index) != ifindex {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[info.Len():])
+		if err != nil {
+			return nil, err
+		}
+
+		result := &linkLimits{lowerNetnsID: netnsidNotAssigned}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case unix.IFLA_IFNAME:
+				result.name = strings.TrimRight(string(attr.Value), "\x00")
+			case unix.IFLA_MTU:
+				result.mtu = int(native.Uint32(attr.Value[0:4]))
+			case iflaMinMTU:
+				result.minMTU = int(native.Uint32(attr.Value[0:4]))
+			case iflaMaxMTU:
+				result.maxMTU = int(native.Uint32(attr.Value[0:4]))
+			case unix.IFLA_LINK:
+				result.lower = int(native.Uint32(attr.Value[0:4]))
+			case nl.IFLA_LINK_NETNSID:
+				result.lowerNetnsID = int(int32(native.Uint32(attr.Value[0:4])))
+			case unix.IFLA_LINKINFO:
+				infos, err := nl.ParseRouteAttr(attr.Value)
+				if err != nil {
+					return nil, err
+				}
+				for _, info := range infos {
+					if info.Attr.Type == nl.IFLA_INFO_KIND {
+						result.kind = strings.TrimRight(string(info.Value), "\x00")
+					}
+				}
+			}
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("no link with ifindex %d", ifindex)
+}
+
+// linkKey identifies a link across namespaces.
+type linkKey struct {
+	inode   uint64
+	ifindex int
+}
+
+// lowerCheck is a link whose planned MTU must not exceed the MTU of its lower
+// device. The lower device may itself be updated in the same run, so the
+// check is made once all changes are planned.
+type lowerCheck struct {
+	link     string
+	inode    uint64
+	mtu      int
+	lower    linkKey
+	name     string
+	lowerMTU int
+}
+
+// preflight checks each planned change of the MTU of a link against the
+// limits of the link and of its lower device. It is passed through the
+// update functions during the preflight pass, in which the changes are only
+// planned, and is nil when the changes are applied. All methods are safe for
+// concurrent use by the namespace workers, and do nothing on a nil
+// preflight.
+type preflight struct {
+	host *namespace
+
+	mu         sync.Mutex
+	planned    map[linkKey]int
+	lowers     []lowerCheck
+	violations []string
+}
+
+func newPreflight(host *namespace) *preflight {
+	return &preflight{
+		host:    host,
+		planned: make(map[linkKey]int),
+	}
+}
+
+func (p *preflight) violate(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.violations = append(p.violations, fmt.Sprintf(format, args...))
+}
+
+// check verifies that the MTU of 'link' in namespace 'ns' can be set to
+// 'mtu'. The MTU must be within the minimum and maximum of the device, and
+// for links with a lower device, not above the MTU of the lower device.
+func (p *preflight) check(ns *namespace, link netlink.Link, mtu int) {
+	if p == nil {
+		return
+	}
+	attrs := link.Attrs()
+	p.mu.Lock()
+	p.planned[linkKey{ns.inode, attrs.Index}] = mtu
+	p.mu.Unlock()
+
+	limits, err := getLinkLimits(ns, attrs.Index)
+	if err != nil {
+		ns.log.WithError(err).Warnf("Failed to read MTU limits of %s", attrs.Name)
+		return
+	}
+	switch {
+	case limits.maxMTU > 0 && mtu > limits.maxMTU:
+		p.violate("%s in netns %d: MTU %d is above the maximum of %d",
+			attrs.Name, ns.inode, mtu, limits.maxMTU)
+	case mtu < limits.minMTU:
+		p.violate("%s in netns %d: MTU %d is below the minimum of %d",
+			attrs.Name, ns.inode, mtu, limits.minMTU)
+	}
+	if !hasLowerDevice(limits.kind) || limits.lower == 0 {
+		return
+	}
+
+	// The lower device of a link in a pod namespace is in the host
+	// namespace when it is in another namespace at all, since only the
+	// host creates such links. The lower device is not updated unless it
+	// is also planned, and its own lower devices already accept its
+	// current MTU, so they need not be checked.
+	lowerNS := ns
+	if limits.lowerNetnsID != netnsidNotAssigned {
+		if ns == p.host {
+			ns.log.Debugf("Lower device of %s is in netns ID %d, not checking its MTU",
+				attrs.Name, limits.lowerNetnsID)
+			return
+		}
+		lowerNS = p.host
+	}
+	lower, err := getLinkLimits(lowerNS, limits.lower)
+	if err != nil {
+		ns.log.WithError(err).Warnf("Failed to read MTU of the lower device of %s",
+			attrs.Name)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lowers = append(p.lowers, lowerCheck{
+		link:     attrs.Name,
+		inode:    ns.inode,
+		mtu:      mtu,
+		lower:    linkKey{lowerNS.inode, limits.lower},
+		name:     lower.name,
+		lowerMTU: lower.mtu,
+	})
+}
+
+// err returns an error listing every link whose MTU cannot be set to the
+// planned MTU, or nil if all of them can.
+func (p *preflight) err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	violations := p.violations
+	for _, c := range p.lowers {
+		lowerMTU, ok := p.planned[c.lower]
+		if !ok {
+			lowerMTU = c.lowerMTU
+		}
+		if c.mtu > lowerMTU {
+			violations = append(violations, fmt.Sprintf(
+				"%s in netns %d: MTU %d is above the MTU %d of lower device %s",
+				c.link, c.inode, c.mtu, lowerMTU, c.name))
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("target MTU cannot be applied: %s",
+		strings.Join(violations, "; "))
+}
+
+// runPreflight plans the update of the managed namespaces in 'namespaces' and
+// the host links 'allLinks' to the specified MTUs without applying it, and
+// checks every planned change against the MTU limits of the link. Returns an
+// error if the MTU of any link cannot be set, so that the update is refused
+// before any change is made.
+func runPreflight(host *namespace, allLinks []netlink.Link, namespaces []*namespace,
+	epInfo *endpointInfo, deviceMTU, tunnelMTU int) error {
+	log.Debug("Checking planned changes against MTU limits")
+	p := newPreflight(host)
+	updatePass(host, allLinks, namespaces, epInfo,
+		newReport(deviceMTU, tunnelMTU), p)
+	return p.err()
+}
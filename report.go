@@ -0,0 +1,374 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	changeLink  = "link"
+	changeRoute = "route"
+	changeClamp = "clamp"
+
+	skipMTUMatches = "MTU already matches"
+	skipNotManaged = "not managed by Cilium"
+	// skipFamilyMismatch namespaces only have managed addresses of
+	// families which are not enabled.
+	skipFamilyMismatch = "address family not enabled"
+	// skipNoPodLinks namespaces have no links of the pod link types.
+	skipNoPodLinks = "no pod links"
+	// skipPairUpdated host links were updated together with their peer
+	// in a pod namespace.
+	skipPairUpdated = "updated with pod link"
+	// skipPairFailed host links were not updated because updating their
+	// peer in a pod namespace failed.
+	skipPairFailed = "pod link failed"
+	// skipRule host links are excluded by their device rule.
+	skipRule = "excluded by device rule"
+	// skipNamespacesFailed host links were not grown because the pod
+	// namespaces could not be updated first.
+	skipNamespacesFailed = "pod namespaces failed"
+)
+
+// change describes a single MTU modification of a link or a route. Changes
+// are recorded regardless of whether they are actually applied, so that they
+// can be presented to the user as a plan in dry-run mode.
+type change struct {
+	Kind    string `json:"kind"`
+	Link    string `json:"link,omitempty"`
+	Ifindex int    `json:"ifindex"`
+	Route   string `json:"route,omitempty"`
+	Class   string `json:"class,omitempty"`
+	OldMTU  int    `json:"oldMTU"`
+	NewMTU  int    `json:"newMTU"`
+
+	// RouteFamily, RouteDst, RouteGw and RouteTable identify the route so
+	// that it can be found again when rolling back the change.
+	RouteFamily string `json:"routeFamily,omitempty"`
+	RouteDst    string `json:"routeDst,omitempty"`
+	RouteGw     string `json:"routeGw,omitempty"`
+	RouteTable  int    `json:"routeTable,omitempty"`
+
+	// OldAdvMSS and NewAdvMSS are the advertised MSS of the route, and
+	// OldLocked and NewLocked whether its MTU is locked.
+	OldAdvMSS int  `json:"oldAdvMSS,omitempty"`
+	NewAdvMSS int  `json:"newAdvMSS,omitempty"`
+	OldLocked bool `json:"oldLocked,omitempty"`
+	NewLocked bool `json:"newLocked,omitempty"`
+
+	// OldRules and NewRules describe the MSS clamping rules installed
+	// in the namespace with the backend in Class, see clamp.go.
+	OldRules []string `json:"oldRules,omitempty"`
+	NewRules []string `json:"newRules,omitempty"`
+}
+
+// String returns a human-readable description of the change.
+func (c *change) String() string {
+	if c.Kind == changeClamp {
+		return fmt.Sprintf("MSS clamping (%s): %s -> %s", c.Class,
+			rulesString(c.OldRules), rulesString(c.NewRules))
+	}
+	target := fmt.Sprintf("link %s (ifindex %d)", c.Link, c.Ifindex)
+	if c.Kind == changeRoute {
+		target = fmt.Sprintf("route %s (%s)", c.Route, c.Class)
+	}
+	result := fmt.Sprintf("%s: MTU %s -> %s", target,
+		mtuString(c.OldMTU), mtuString(c.NewMTU))
+	if c.OldAdvMSS != c.NewAdvMSS {
+		result += fmt.Sprintf(", advmss %s -> %s",
+			mtuString(c.OldAdvMSS), mtuString(c.NewAdvMSS))
+	}
+	if c.OldLocked != c.NewLocked {
+		result += fmt.Sprintf(", lock %t -> %t", c.OldLocked, c.NewLocked)
+	}
+	return result
+}
+
+// rulesString formats MSS clamping rules for display.
+func rulesString(rules []string) string {
+	if len(rules) == 0 {
+		return "none"
+	}
+	return strings.Join(rules, "; ")
+}
+
+// mtuString formats an MTU for display. Routes without an explicit MTU
+// report an MTU of zero, which means they inherit the MTU of the link.
+func mtuString(mtu int) string {
+	if mtu == 0 {
+		return "unset"
+	}
+	return strconv.Itoa(mtu)
+}
+
+// nsReport records what was (or would be) done in a single network
+// namespace.
+type nsReport struct {
+	Inode   uint64           `json:"inode"`
+	PIDs    []int            `json:"pids"`
+	Sources []string         `json:"sources,omitempty"`
+	Links   []*podLinkReport `json:"links,omitempty"`
+	Managed bool             `json:"managed"`
+	Changes []*change        `json:"changes,omitempty"`
+	Skipped string           `json:"skipped,omitempty"`
+	Error   string           `json:"error,omitempty"`
+
+	// Probes holds the results of the path MTU verification, if enabled.
+	Probes []*probeResult `json:"probes,omitempty"`
+}
+
+// podLinkReport records how a single link in a pod namespace was matched
+// against the endpoints, and why it was skipped or failed. The changes are
+// recorded in the nsReport.
+type podLinkReport struct {
+	Name      string   `json:"name"`
+	Ifindex   int      `json:"ifindex"`
+	Type      string   `json:"type"`
+	Addresses []string `json:"addresses,omitempty"`
+	Endpoint  int64    `json:"endpoint,omitempty"`
+	Skipped   string   `json:"skipped,omitempty"`
+	Error     string   `json:"error,omitempty"`
+
+	// Peer and PeerIfindex identify the host side of the pair, and
+	// PeerChange is the change made to it, if any.
+	Peer        string  `json:"peer,omitempty"`
+	PeerIfindex int     `json:"peerIfindex,omitempty"`
+	PeerChange  *change `json:"peerChange,omitempty"`
+}
+
+// linkReport records what was (or would be) done to a single link in the
+// host namespace.
+type linkReport struct {
+	Name     string  `json:"name"`
+	Ifindex  int     `json:"ifindex"`
+	Type     string  `json:"type"`
+	Endpoint int64   `json:"endpoint,omitempty"`
+	Rule     string  `json:"rule,omitempty"`
+	Change   *change `json:"change,omitempty"`
+	Skipped  string  `json:"skipped,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// report collects the outcome of a full run across all namespaces and host
+// links.
+type report struct {
+	Hostname  string `json:"hostname"`
+	DryRun    bool   `json:"dryRun"`
+	DeviceMTU int    `json:"deviceMTU"`
+	TunnelMTU int    `json:"tunnelMTU"`
+
+	// Encapsulation and TunnelMTUByFamily describe how the tunnel MTU
+	// was derived for each underlay family.
+	Encapsulation     string         `json:"encapsulation,omitempty"`
+	TunnelMTUByFamily map[string]int `json:"tunnelMTUByFamily,omitempty"`
+
+	// Agent is the Cilium agent configuration the MTUs were derived
+	// from, if any.
+	Agent *agentConfig `json:"agent,omitempty"`
+
+	// MTUSource is where the device MTU was taken from, see
+	// resolveBaseMTU().
+	MTUSource string `json:"mtuSource,omitempty"`
+
+	// Platform is the cloud platform given with --platform, if any, and
+	// PlatformOverhead the overhead of its network which was added to the
+	// tunnel overheads. The platform only supplied the device MTU if
+	// MTUSource is "platform".
+	Platform         string `json:"platform,omitempty"`
+	PlatformOverhead int    `json:"platformOverhead,omitempty"`
+
+	Namespaces []*nsReport   `json:"namespaces"`
+	HostLinks  []*linkReport `json:"hostLinks"`
+
+	// Clamp and ClampError record the change of the MSS clamping rules
+	// in the host namespace, if any.
+	Clamp      *change `json:"clamp,omitempty"`
+	ClampError string  `json:"clampError,omitempty"`
+
+	Failed int    `json:"failed"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newReport(deviceMTU, tunnelMTU int) *report {
+	hostname, _ := os.Hostname()
+	return &report{
+		Hostname:   hostname,
+		DryRun:     dryRun,
+		DeviceMTU:  deviceMTU,
+		TunnelMTU:  tunnelMTU,
+		Namespaces: []*nsReport{},
+		HostLinks:  []*linkReport{},
+	}
+}
+
+// addNamespace creates a new record for the namespace with the specified
+// inode, PIDs and discovery sources, and adds it to the report.
+func (r *report) addNamespace(inode uint64, pids []int, sources []string) *nsReport {
+	nsr := &nsReport{
+		Inode:   inode,
+		PIDs:    pids,
+		Sources: sources,
+	}
+	r.Namespaces = append(r.Namespaces, nsr)
+	return nsr
+}
+
+// addLink creates a new record for the specified pod link, and adds it to
+// the namespace report.
+func (nsr *nsReport) addLink(link netlink.Link) *podLinkReport {
+	plr := &podLinkReport{
+		Name:    link.Attrs().Name,
+		Ifindex: link.Attrs().Index,
+		Type:    link.Type(),
+	}
+	nsr.Links = append(nsr.Links, plr)
+	return plr
+}
+
+// addHostLink creates a new record for the specified host link, and adds it
+// to the report.
+func (r *report) addHostLink(link netlink.Link) *linkReport {
+	lr := &linkReport{
+		Name:    link.Attrs().Name,
+		Ifindex: link.Attrs().Index,
+		Type:    link.Type(),
+	}
+	r.HostLinks = append(r.HostLinks, lr)
+	return lr
+}
+
+// changed returns true if any links or routes in the namespace, or the host
+// side of any of its pod links, were changed.
+func (nsr *nsReport) changed() bool {
+	if len(nsr.Changes) > 0 {
+		return true
+	}
+	for _, plr := range nsr.Links {
+		if plr.PeerChange != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// done returns true if the namespace needs no further attention, ie it was
+// either updated or already had the desired MTU.
+func (nsr *nsReport) done() bool {
+	if nsr.Error != "" {
+		return false
+	}
+	return nsr.changed() || nsr.Skipped == skipMTUMatches
+}
+
+func formatPIDs(pids []int) string {
+	if len(pids) == 0 {
+		return "none"
+	}
+	result := make([]string, 0, len(pids))
+	for _, pid := range pids {
+		result = append(result, strconv.Itoa(pid))
+	}
+	return strings.Join(result, ", ")
+}
+
+// writePlan prints a human-readable plan of all changes in the report to
+// the specified writer.
+func (r *report) writePlan(w io.Writer) {
+	fmt.Fprintf(w, "Plan: device MTU %d, tunnel MTU %d\n",
+		r.DeviceMTU, r.TunnelMTU)
+
+	for _, nsr := range r.Namespaces {
+		fmt.Fprintf(w, "Namespace %d (pids %s; found via %s):\n",
+			nsr.Inode, formatPIDs(nsr.PIDs),
+			strings.Join(nsr.Sources, ", "))
+		for _, c := range nsr.Changes {
+			fmt.Fprintf(w, "  %s\n", c)
+		}
+		for _, plr := range nsr.Links {
+			if plr.PeerChange != nil {
+				fmt.Fprintf(w, "  host peer of %s: %s\n",
+					plr.Name, plr.PeerChange)
+			}
+			if plr.Skipped != "" && len(nsr.Links) > 1 {
+				fmt.Fprintf(w, "  link %s (ifindex %d): skipped: %s\n",
+					plr.Name, plr.Ifindex, plr.Skipped)
+			}
+		}
+		if nsr.Skipped != "" {
+			fmt.Fprintf(w, "  skipped: %s\n", nsr.Skipped)
+		}
+		if nsr.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", nsr.Error)
+		}
+	}
+
+	fmt.Fprintf(w, "Host namespace:\n")
+	for _, lr := range r.HostLinks {
+		switch {
+		case lr.Change != nil && lr.Rule != "":
+			fmt.Fprintf(w, "  %s (rule %s)\n", lr.Change, lr.Rule)
+		case lr.Change != nil:
+			fmt.Fprintf(w, "  %s\n", lr.Change)
+		case lr.Skipped != "":
+			fmt.Fprintf(w, "  link %s (ifindex %d): skipped: %s\n",
+				lr.Name, lr.Ifindex, lr.Skipped)
+		}
+		if lr.Error != "" {
+			fmt.Fprintf(w, "  link %s (ifindex %d): error: %s\n",
+				lr.Name, lr.Ifindex, lr.Error)
+		}
+	}
+	if r.Clamp != nil {
+		fmt.Fprintf(w, "  %s\n", r.Clamp)
+	}
+	if r.ClampError != "" {
+		fmt.Fprintf(w, "  MSS clamping: error: %s\n", r.ClampError)
+	}
+}
+
+// writeJSON writes the report to the specified writer as a JSON document.
+func (r *report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// writeFile atomically replaces the file at the specified path with the
+// report in JSON format.
+func (r *report) writeFile(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := r.writeJSON(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
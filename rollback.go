@@ -0,0 +1,257 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	rollbackCmd = &cobra.Command{
+		Use:   "rollback",
+		Short: "Revert all MTU changes recorded in the journal.",
+		Run: func(cmd *cobra.Command, args []string) {
+			runRollback(cmd)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+}
+
+// pidInNamespace returns true if the process with the specified PID lives
+// in the network namespace with the specified inode.
+func pidInNamespace(pid int, inode uint64) bool {
+	var statInfo syscall.Stat_t
+	if err := syscall.Stat(fmt.Sprintf("/proc/%d/ns/net", pid), &statInfo); err != nil {
+		return false
+	}
+	return statInfo.Ino == inode
+}
+
+// isRecordedNamespace returns true if 'ns' is the namespace in which the
+// journal entry was recorded. The inode of a namespace which no longer
+// exists may be reused by a new one, so at least one of the processes
+// recorded in the entry must still live in the namespace. Entries without
+// processes, eg for namespaces only held by bind mounts, are identified by
+// the inode alone.
+func isRecordedNamespace(ns *namespace, entry *journalEntry) bool {
+	if len(entry.PIDs) == 0 {
+		return true
+	}
+	for _, pid := range entry.PIDs {
+		if pidInNamespace(pid, ns.inode) {
+			return true
+		}
+	}
+	return false
+}
+
+// changedLink returns the link modified by 'c' in the namespace, checking
+// that its ifindex still belongs to a link of the same name. Changes
+// recorded without the name of the link are not checked.
+func changedLink(ns *namespace, c *change) (netlink.Link, error) {
+	link, err := ns.nl.LinkByIndex(c.Ifindex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find link %s: %s", c.Link, err)
+	}
+	if name := link.Attrs().Name; c.Link != "" && name != c.Link {
+		return nil, fmt.Errorf("link with ifindex %d is now %s, expected %s",
+			c.Ifindex, name, c.Link)
+	}
+	return link, nil
+}
+
+// rollbackLink restores the MTU of the link modified by 'c' in the namespace.
+// Returns true if the link was modified.
+func rollbackLink(ns *namespace, c *change) (bool, error) {
+	link, err := changedLink(ns, c)
+	if err != nil {
+		return false, err
+	}
+	if link.Attrs().MTU == c.OldMTU {
+		return false, nil
+	}
+
+	return true, ns.nl.LinkSetMTU(link, c.OldMTU)
+}
+
+// rollbackRoute restores the MTU, advertised MSS and MTU lock of the route
+// modified by 'c' in the namespace. Returns true if the route was modified.
+func rollbackRoute(ns *namespace, c *change) (bool, error) {
+	link, err := changedLink(ns, c)
+	if err != nil {
+		return false, fmt.Errorf("route %s: %s", c.Route, err)
+	}
+	nlFamily := netlink.FAMILY_ALL
+	if c.RouteFamily != "" {
+		nlFamily = familyNetlink(c.RouteFamily)
+	}
+	routes, err := ns.nl.RouteListFiltered(nlFamily,
+		&netlink.Route{LinkIndex: link.Attrs().Index, Table: c.RouteTable},
+		netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return false, fmt.Errorf("failed to list routes: %s", err)
+	}
+
+	for _, r := range routes {
+		if !routeMatches(&r, c) {
+			continue
+		}
+		if r.MTU == c.OldMTU && r.AdvMSS == c.OldAdvMSS && !c.NewLocked {
+			return false, nil
+		}
+		family := c.RouteFamily
+		if family == "" {
+			family = routeFamily(&r)
+		}
+		r.MTU = c.OldMTU
+		r.AdvMSS = c.OldAdvMSS
+		return true, replaceRoute(ns, &r, family, c.OldLocked)
+	}
+
+	return false, fmt.Errorf("route %s no longer exists", c.Route)
+}
+
+// rollbackEntry reverts the change described by the journal entry in the
+// namespace. Returns true if anything was modified.
+func rollbackEntry(ns *namespace, entry *journalEntry) (bool, error) {
+	switch entry.Kind {
+	case changeLink:
+		return rollbackLink(ns, &entry.change)
+	case changeRoute:
+		return rollbackRoute(ns, &entry.change)
+	case changeClamp:
+		return removeClampRules(ns, entry.Class)
+	}
+	return false, fmt.Errorf("unknown change kind %q", entry.Kind)
+}
+
+// rollbackJournal replays the journal entries in reverse order, restoring
+// the MTU that each link and route had before it was changed and removing
+// the MSS clamping rules which were installed.
+//
+// Returns the number of entries that failed to be reverted.
+func rollbackJournal(entries []*journalEntry) (int, error) {
+	rootNamespace, namespaces, err := scanNamespaces()
+	if err != nil {
+		return 0, err
+	}
+	byInode := make(map[uint64]*namespace, len(namespaces)+1)
+	byInode[rootNamespace.inode] = rootNamespace
+	for _, ns := range namespaces {
+		byInode[ns.inode] = ns
+	}
+
+	failed := replayJournal(entries, byInode, rollbackEntry)
+
+	closeNamespaces(rootNamespace, namespaces)
+
+	return failed, nil
+}
+
+// replayJournal reverts the journal entries in reverse order with 'revert',
+// in the namespaces of 'byInode'. Entries for namespaces which no longer
+// exist, or whose inode now belongs to another namespace, are skipped.
+//
+// Returns the number of entries that failed to be reverted.
+func replayJournal(entries []*journalEntry, byInode map[uint64]*namespace,
+	revert func(*namespace, *journalEntry) (bool, error)) int {
+	var (
+		skipped  int
+		failed   int
+		reverted int
+	)
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		scopedLog := log.WithFields(logrus.Fields{
+			"netns":   entry.Namespace,
+			"ifindex": entry.Ifindex,
+		})
+
+		ns, ok := byInode[entry.Namespace]
+		if !ok {
+			scopedLog.Infof("Namespace no longer exists, skipping %s",
+				&entry.change)
+			skipped++
+			continue
+		}
+		if !isRecordedNamespace(ns, entry) {
+			scopedLog.Infof("Namespace was replaced (pids %s exited), skipping %s",
+				formatPIDs(entry.PIDs), &entry.change)
+			skipped++
+			continue
+		}
+		if err := ns.openNetlink(); err != nil {
+			failed++
+			scopedLog.WithError(err).Warn("Failed to enter netns")
+			continue
+		}
+
+		ok, err := revert(ns, entry)
+		switch {
+		case err != nil:
+			failed++
+			scopedLog.WithError(err).Warnf("Failed to revert %s",
+				&entry.change)
+		case ok:
+			reverted++
+			scopedLog.Debugf("Reverted %s", &entry.change)
+		default:
+			skipped++
+			scopedLog.Debugf("Already reverted %s", &entry.change)
+		}
+	}
+
+	log.Infof("Reverted %d/%d changes, %d skipped, %d failed",
+		reverted, len(entries), skipped, failed)
+
+	return failed
+}
+
+func runRollback(cmd *cobra.Command) {
+	if verbose {
+		log.Level = logrus.DebugLevel
+	}
+
+	if journalPath == "" {
+		log.Fatal("No journal specified")
+	}
+	entries, err := readJournal(journalPath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to read journal")
+	}
+
+	failed, err := rollbackJournal(entries)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to find network namespaces")
+	}
+	if failed > 0 {
+		log.Fatalf("%d MTU rollback operations failed", failed)
+	}
+
+	// Everything has been reverted, so start over with a fresh journal.
+	if err := os.Remove(journalPath); err != nil {
+		log.WithError(err).Warn("Failed to remove journal")
+	}
+}
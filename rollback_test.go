@@ -0,0 +1,124 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// exitedPID is a PID which cannot belong to a live process, as it exceeds
+// the maximum PID of Linux.
+const exitedPID = 1 << 30
+
+func TestReplayJournal(t *testing.T) {
+	host, err := currentNamespace()
+	if err != nil {
+		t.Fatalf("failed to open host netns: %s", err)
+	}
+	defer host.Close()
+
+	// The namespace whose inode was reused is skipped before being entered.
+	const replacedInode = 4026532200
+	byInode := map[uint64]*namespace{
+		host.inode:    host,
+		replacedInode: {inode: replacedInode},
+	}
+
+	entries := []*journalEntry{
+		{Namespace: host.inode, change: change{Kind: changeLink, Link: "first"}},
+		{Namespace: host.inode, PIDs: []int{exitedPID, os.Getpid()},
+			change: change{Kind: changeLink, Link: "live pid"}},
+		{Namespace: replacedInode, PIDs: []int{exitedPID},
+			change: change{Kind: changeLink, Link: "replaced"}},
+		{Namespace: 1, change: change{Kind: changeLink, Link: "gone"}},
+		{Namespace: host.inode, change: change{Kind: changeLink, Link: "reverted"}},
+		{Namespace: host.inode, change: change{Kind: changeLink, Link: "failed"}},
+		{Namespace: host.inode, change: change{Kind: changeLink, Link: "last"}},
+	}
+
+	var replayed []string
+	revert := func(ns *namespace, entry *journalEntry) (bool, error) {
+		replayed = append(replayed, entry.Link)
+		switch entry.Link {
+		case "reverted":
+			return false, nil
+		case "failed":
+			return false, fmt.Errorf("stubbed failure")
+		}
+		return true, nil
+	}
+
+	failed := replayJournal(entries, byInode, revert)
+	if failed != 1 {
+		t.Errorf("%d entries failed, expected 1", failed)
+	}
+	expected := []string{"last", "failed", "reverted", "live pid", "first"}
+	if !reflect.DeepEqual(replayed, expected) {
+		t.Errorf("replayed %v, expected %v", replayed, expected)
+	}
+}
+
+func TestChangedLink(t *testing.T) {
+	host, err := currentNamespace()
+	if err != nil {
+		t.Fatalf("failed to open host netns: %s", err)
+	}
+	defer host.Close()
+
+	lo, err := host.nl.LinkByName("lo")
+	if err != nil {
+		t.Fatalf("failed to find loopback: %s", err)
+	}
+	index := lo.Attrs().Index
+
+	tests := []struct {
+		name    string
+		link    string
+		ifindex int
+		valid   bool
+	}{
+		{name: "same name", link: "lo", ifindex: index, valid: true},
+		{name: "unnamed", ifindex: index, valid: true},
+		{name: "renamed", link: "eth0", ifindex: index},
+		{name: "deleted", link: "lo", ifindex: 1 << 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &change{Kind: changeLink, Link: tt.link, Ifindex: tt.ifindex,
+				OldMTU: lo.Attrs().MTU}
+			_, err := changedLink(host, c)
+			if tt.valid && err != nil {
+				t.Errorf("link %s with ifindex %d not found: %s", tt.link, tt.ifindex, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("link %s with ifindex %d found, expected an error", tt.link, tt.ifindex)
+			}
+
+			// The MTU is unchanged, so the rollback never modifies
+			// the link.
+			modified, err := rollbackLink(host, c)
+			if tt.valid && (err != nil || modified) {
+				t.Errorf("rollback modified %t, error %v, expected no change", modified, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("rollback succeeded, expected an error")
+			}
+		})
+	}
+}
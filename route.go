@@ -15,7 +15,26 @@
 package main
 
 import (
+	"fmt"
+	"net"
+
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// routesDefault selects only the default routes for updating.
+	routesDefault = "default"
+	// routesAll selects all unicast routes via the primary link.
+	routesAll = "all"
+
+	// routeLocal routes lead to destinations on the same node, which are
+	// reached without encapsulation.
+	routeLocal = "local"
+	// routeRemote routes lead to pods on other nodes via the tunnel.
+	routeRemote = "remote"
+	// routeExternal routes lead to destinations outside of the cluster.
+	routeExternal = "external"
 )
 
 // isDefault returns true if this is a default route, ie its mask is 0.
@@ -23,24 +42,235 @@ func isDefault(route *netlink.Route) bool {
 	return route.Dst == nil
 }
 
-// getDefaultRoutes fetches the default routes (both IPv4 and IPv6).
-func getDefaultRoutes() ([]netlink.Route, error) {
-	scopedLog.Debug("Listing routes")
-	routes, err := netlink.RouteList(nil, 0)
+// familyRoute is a route along with the address family it was listed with,
+// which cannot be derived from the addresses of eg a default route via a
+// link without a gateway.
+type familyRoute struct {
+	netlink.Route
+	family string
+}
+
+// listRoutes fetches the routes of each enabled pod address family via the
+// specified link in the namespace, or via all links if 'link' is nil.
+func listRoutes(ns *namespace, link netlink.Link) ([]familyRoute, error) {
+	ns.log.Debug("Listing routes")
+	result := []familyRoute{}
+	for _, family := range podFamilies() {
+		routes, err := ns.nl.RouteList(link, familyNetlink(family))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range routes {
+			result = append(result, familyRoute{Route: r, family: family})
+		}
+	}
+	ns.log.Debugf("Found %d routes", len(result))
+	return result, nil
+}
+
+// getDefaultRoutes fetches the default routes of the enabled pod address
+// families via the specified link in the namespace. If 'link' is nil, the
+// default routes via all links are returned.
+func getDefaultRoutes(ns *namespace, link netlink.Link) ([]familyRoute, error) {
+	routes, err := listRoutes(ns, link)
 	if err != nil {
 		return nil, err
 	}
 
-	scopedLog.Debugf("Found %d routes", len(routes))
-
-	result := make([]netlink.Route, 0, 2)
+	result := make([]familyRoute, 0, 2)
 	for _, r := range routes {
-		scopedLog.Debugf("  %+v", r)
-		if isDefault(&r) {
-			scopedLog.Debugf("  => Adding to defaults")
+		ns.log.Debugf("  %+v", r)
+		if isDefault(&r.Route) {
+			ns.log.Debugf("  => Adding to defaults")
 			result = append(result, r)
 		}
 	}
 
 	return result, nil
 }
+
+// defaultRouteLink returns the link of the default route in the namespace,
+// preferring IPv4 over IPv6. Returns an error if there is no default route
+// via a link.
+func defaultRouteLink(ns *namespace) (netlink.Link, error) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := ns.nl.RouteList(nil, family)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range routes {
+			if !isDefault(&r) || r.LinkIndex == 0 {
+				continue
+			}
+			link, err := ns.nl.LinkByIndex(r.LinkIndex)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get link of default route: %s", err)
+			}
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("no default route")
+}
+
+// getRoutes fetches the routes via the specified link in the namespace which
+// are selected by the route selection policy.
+func getRoutes(ns *namespace, link netlink.Link) ([]familyRoute, error) {
+	if routeSelection == routesDefault {
+		return getDefaultRoutes(ns, link)
+	}
+
+	routes, err := listRoutes(ns, link)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]familyRoute, 0, len(routes))
+	for _, r := range routes {
+		ns.log.Debugf("  %+v", r)
+		if r.Type != unix.RTN_UNICAST {
+			continue
+		}
+		result = append(result, r)
+	}
+
+	return result, nil
+}
+
+// cidrsContain returns true if the destination is entirely contained in one
+// of the specified CIDRs.
+func cidrsContain(cidrs []*net.IPNet, dst *net.IPNet) bool {
+	dstOnes, _ := dst.Mask.Size()
+	for _, cidr := range cidrs {
+		ones, _ := cidr.Mask.Size()
+		if cidr.Contains(dst.IP) && dstOnes >= ones {
+			return true
+		}
+	}
+	return false
+}
+
+// isHostRoute returns true if the route leads to a single address.
+func isHostRoute(route *netlink.Route) bool {
+	ones, bits := route.Dst.Mask.Size()
+	return ones == bits
+}
+
+// classifyRoute determines whether traffic using the route stays on the
+// node, is tunnelled to another node, or leaves the cluster. The local pod
+// CIDRs are provided by 'epInfo', and the cluster CIDRs by the configuration.
+//
+// Default routes cover the pods on other nodes, so are classified as remote.
+func classifyRoute(route *netlink.Route, epInfo *endpointInfo) string {
+	if isDefault(route) {
+		return routeRemote
+	}
+
+	// Link-scoped host routes lead to the gateway on the local node.
+	if cidrsContain(epInfo.localCIDRs, route.Dst) ||
+		(route.Gw == nil && route.Scope == netlink.SCOPE_LINK && isHostRoute(route)) {
+		return routeLocal
+	}
+
+	if cidrsContain(clusterCIDRs, route.Dst) {
+		return routeRemote
+	}
+	return routeExternal
+}
+
+// routeClassMTU returns the MTU to configure for routes of the specified
+// class. External destinations may still be reached via the tunnel, so they
+// conservatively use the tunnel MTU.
+func routeClassMTU(class string, deviceMTU, tunnelMTU int) int {
+	if class == routeLocal {
+		return deviceMTU
+	}
+	return tunnelMTU
+}
+
+// routeString returns a short, human-readable description of the route.
+func routeString(route *netlink.Route) string {
+	dst := "default"
+	if route.Dst != nil {
+		dst = route.Dst.String()
+	}
+	if route.Gw != nil {
+		return fmt.Sprintf("%s via %s ifindex %d", dst, route.Gw,
+			route.LinkIndex)
+	}
+	return fmt.Sprintf("%s ifindex %d", dst, route.LinkIndex)
+}
+
+// routeDst returns the destination of the route as a string, or an empty
+// string for default routes.
+func routeDst(route *netlink.Route) string {
+	if route.Dst == nil {
+		return ""
+	}
+	return route.Dst.String()
+}
+
+// routeGw returns the gateway of the route as a string, or an empty string
+// if the route has no gateway.
+func routeGw(route *netlink.Route) string {
+	if route.Gw == nil {
+		return ""
+	}
+	return route.Gw.String()
+}
+
+// routeMatches returns true if the route is the one modified by 'c'.
+func routeMatches(route *netlink.Route, c *change) bool {
+	return route.LinkIndex == c.Ifindex &&
+		routeDst(route) == c.RouteDst &&
+		routeGw(route) == c.RouteGw &&
+		route.Table == c.RouteTable
+}
+
+// routeTarget returns the advertised MSS and whether the MTU is locked for a
+// route with MTU 'mtu', according to the route options. The advertised MSS
+// of the route is kept unless it is set from the MTU.
+func routeTarget(route *familyRoute, mtu int) (int, bool) {
+	advmss := route.AdvMSS
+	if setAdvMSS {
+		advmss = advMSS(route.family, mtu)
+	}
+	return advmss, lockRouteMTU
+}
+
+// setRouteMTU records a change of the MTU of the route of the specified class
+// via the link named 'link' in namespace 'ns' to 'mtu', along with its
+// advertised MSS and MTU lock as returned by routeTarget(). 'locked' is
+// whether the MTU of the route is currently locked. Unless running in
+// dry-run mode or planning the preflight 'p', replaces the route with the
+// new MTU.
+func setRouteMTU(ns *namespace, route familyRoute, link, class string, mtu int,
+	locked bool, p *preflight) (*change, error) {
+	advmss, lock := routeTarget(&route, mtu)
+	c := &change{
+		Kind:        changeRoute,
+		Link:        link,
+		Ifindex:     route.LinkIndex,
+		Route:       routeString(&route.Route),
+		Class:       class,
+		OldMTU:      route.MTU,
+		NewMTU:      mtu,
+		RouteFamily: route.family,
+		RouteDst:    routeDst(&route.Route),
+		RouteGw:     routeGw(&route.Route),
+		RouteTable:  route.Table,
+		OldAdvMSS:   route.AdvMSS,
+		NewAdvMSS:   advmss,
+		OldLocked:   locked,
+		NewLocked:   lock,
+	}
+	if dryRun || p != nil {
+		return c, nil
+	}
+	if err := changeJournal.record(ns, c); err != nil {
+		return c, err
+	}
+
+	route.MTU = mtu
+	route.AdvMSS = advmss
+	return c, replaceRoute(ns, &route.Route, route.family, lock)
+}
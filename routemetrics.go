@@ -0,0 +1,221 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tcpHeaderLen = 20
+
+	// rtaxLockMTU is the bit of the RTAX_LOCK metric which prevents the
+	// kernel from lowering the route MTU in response to path MTU
+	// discovery.
+	rtaxLockMTU = 1 << unix.RTAX_MTU
+)
+
+// routeFamily returns the address family of the route, or an empty string
+// if the route has no address to derive it from. It is only used for
+// changes recorded without the family the route was listed with.
+func routeFamily(route *netlink.Route) string {
+	switch {
+	case route.Dst != nil && route.Dst.IP != nil:
+		return ipFamily(route.Dst.IP)
+	case route.Gw != nil:
+		return ipFamily(route.Gw)
+	case route.Src != nil:
+		return ipFamily(route.Src)
+	}
+	return ""
+}
+
+// advMSS returns the TCP MSS to advertise for connections over a route of
+// the specified family when its MTU is 'mtu', ie the MTU less the IP and
+// TCP headers.
+func advMSS(family string, mtu int) int {
+	return mtu - ipHeaderLen(family) - tcpHeaderLen
+}
+
+// routeKey identifies a route by the same attributes as routeMatches().
+func routeKey(route *netlink.Route) string {
+	return fmt.Sprintf("%d|%s|%s|%d", route.LinkIndex, routeDst(route),
+		routeGw(route), route.Table)
+}
+
+// execute sends the request over a netlink socket opened in the namespace,
+// and returns the responses of type 'resType'.
+func (ns *namespace) execute(req *nl.NetlinkRequest, resType uint16) ([][]byte, error) {
+	sock, err := nl.GetNetlinkSocketAt(ns.handle, netns.None(), unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer sock.Close()
+
+	req.Sockets = map[int]*nl.SocketHandle{
+		unix.NETLINK_ROUTE: {Socket: sock},
+	}
+	return req.Execute(unix.NETLINK_ROUTE, resType)
+}
+
+// getLockedRoutes returns the keys of the routes of the specified family in
+// namespace 'ns' whose MTU is locked. The netlink library does not report
+// locked metrics, so the routes are dumped and parsed here.
+func getLockedRoutes(ns *namespace, family int) (map[string]bool, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETROUTE, unix.NLM_F_DUMP)
+	req.AddData(&nl.RtMsg{RtMsg: unix.RtMsg{Family: uint8(family)}})
+
+	msgs, err := ns.execute(req, unix.RTM_NEWROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	native := nl.NativeEndian()
+	result := make(map[string]bool)
+	for _, m := range msgs {
+		msg := nl.DeserializeRtMsg(m)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+
+		route := netlink.Route{Table: int(msg.Table)}
+		locked := false
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case unix.RTA_DST:
+				route.Dst = &net.IPNet{
+					IP:   net.IP(attr.Value),
+					Mask: net.CIDRMask(int(msg.Dst_len), 8*len(attr.Value)),
+				}
+			case unix.RTA_GATEWAY:
+				route.Gw = net.IP(attr.Value)
+			case unix.RTA_OIF:
+				route.LinkIndex = int(native.Uint32(attr.Value[0:4]))
+			case unix.RTA_TABLE:
+				route.Table = int(native.Uint32(attr.Value[0:4]))
+			case unix.RTA_METRICS:
+				metrics, err := nl.ParseRouteAttr(attr.Value)
+				if err != nil {
+					return nil, err
+				}
+				for _, metric := range metrics {
+					if metric.Attr.Type == unix.RTAX_LOCK {
+						lock := native.Uint32(metric.Value[0:4])
+						locked = lock&rtaxLockMTU != 0
+					}
+				}
+			}
+		}
+		if locked {
+			result[routeKey(&route)] = true
+		}
+	}
+	return result, nil
+}
+
+// replaceRoute replaces the route of the specified family in namespace 'ns'.
+// If 'lock' is true, the MTU of the route is locked, which the netlink
+// library does not support, and the library cannot replace routes without a
+// destination, gateway or source to derive the family from, eg a default
+// route via a link, so the request is built here in either case. Only
+// single-path routes without encapsulation can be replaced this way.
+func replaceRoute(ns *namespace, route *netlink.Route, family string, lock bool) error {
+	if !lock && routeFamily(route) != "" {
+		return ns.nl.RouteReplace(route)
+	}
+	if len(route.MultiPath) > 0 || route.Encap != nil || route.NewDst != nil || route.MPLSDst != nil {
+		return fmt.Errorf("cannot replace multipath or encapsulated route without a destination or lock its MTU")
+	}
+
+	req := nl.NewNetlinkRequest(unix.RTM_NEWROUTE,
+		unix.NLM_F_CREATE|unix.NLM_F_REPLACE|unix.NLM_F_ACK)
+	msg := nl.NewRtMsg()
+	attrs := []*nl.RtAttr{}
+
+	ipData := func(ip net.IP) []byte {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+		return ip.To16()
+	}
+	switch family {
+	case familyIPv4:
+		msg.Family = unix.AF_INET
+	case familyIPv6:
+		msg.Family = unix.AF_INET6
+	default:
+		return fmt.Errorf("unknown address family of route")
+	}
+	if route.Dst != nil && route.Dst.IP != nil {
+		ones, _ := route.Dst.Mask.Size()
+		msg.Dst_len = uint8(ones)
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_DST, ipData(route.Dst.IP)))
+	}
+	if route.Src != nil {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_PREFSRC, ipData(route.Src)))
+	}
+	if route.Gw != nil {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_GATEWAY, ipData(route.Gw)))
+	}
+	if route.Table >= 256 {
+		msg.Table = unix.RT_TABLE_UNSPEC
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_TABLE, nl.Uint32Attr(uint32(route.Table))))
+	} else if route.Table > 0 {
+		msg.Table = uint8(route.Table)
+	}
+	if route.Priority > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_PRIORITY, nl.Uint32Attr(uint32(route.Priority))))
+	}
+	if route.Tos > 0 {
+		msg.Tos = uint8(route.Tos)
+	}
+	if route.Protocol > 0 {
+		msg.Protocol = uint8(route.Protocol)
+	}
+	if route.Type > 0 {
+		msg.Type = uint8(route.Type)
+	}
+	// Flags such as RTNH_F_LINKDOWN are reported by the kernel but
+	// refused in requests.
+	msg.Flags = uint32(route.Flags) & unix.RTNH_F_ONLINK
+	msg.Scope = uint8(route.Scope)
+
+	metrics := nl.NewRtAttr(unix.RTA_METRICS, nil)
+	if route.MTU > 0 {
+		metrics.AddChild(nl.NewRtAttr(unix.RTAX_MTU, nl.Uint32Attr(uint32(route.MTU))))
+		if lock {
+			metrics.AddChild(nl.NewRtAttr(unix.RTAX_LOCK, nl.Uint32Attr(rtaxLockMTU)))
+		}
+	}
+	if route.AdvMSS > 0 {
+		metrics.AddChild(nl.NewRtAttr(unix.RTAX_ADVMSS, nl.Uint32Attr(uint32(route.AdvMSS))))
+	}
+	attrs = append(attrs, metrics)
+	attrs = append(attrs, nl.NewRtAttr(unix.RTA_OIF, nl.Uint32Attr(uint32(route.LinkIndex))))
+
+	req.AddData(msg)
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	_, err := ns.execute(req, 0)
+	return err
+}
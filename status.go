@@ -0,0 +1,194 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	phaseStarting = "starting"
+	phaseUpdating = "updating"
+	phaseWatching = "watching"
+	phaseDone     = "done"
+	phaseFailed   = "failed"
+)
+
+// resultCounts counts the outcome of the updates in a pass.
+type resultCounts struct {
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+func (c *resultCounts) add(changed bool, err string) {
+	switch {
+	case err != "":
+		c.Failed++
+	case changed:
+		c.Updated++
+	default:
+		c.Skipped++
+	}
+}
+
+// runStatus tracks the state of the run for the health and status
+// endpoints. All methods are safe for concurrent use, and do nothing on a
+// nil runStatus.
+type runStatus struct {
+	mu sync.Mutex
+
+	Phase     string    `json:"phase"`
+	Started   time.Time `json:"started"`
+	DeviceMTU int       `json:"deviceMTU,omitempty"`
+	TunnelMTU int       `json:"tunnelMTU,omitempty"`
+
+	// Passes is the number of full passes completed, and the remaining
+	// fields describe the outcome of the last one.
+	Passes     int          `json:"passes"`
+	LastPass   *time.Time   `json:"lastPass,omitempty"`
+	Namespaces resultCounts `json:"namespaces"`
+	HostLinks  resultCounts `json:"hostLinks"`
+	Failed     int          `json:"failed"`
+
+	LastError string `json:"lastError,omitempty"`
+}
+
+func newRunStatus() *runStatus {
+	return &runStatus{
+		Phase:   phaseStarting,
+		Started: time.Now(),
+	}
+}
+
+// setPhase records the phase of the run.
+func (s *runStatus) setPhase(phase string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Phase = phase
+}
+
+// setError records an error which prevented a pass from completing.
+func (s *runStatus) setError(err error, msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastError = fmt.Sprintf("%s: %s", msg, err)
+}
+
+// fail records an error which ended the run.
+func (s *runStatus) fail(err error, msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Phase = phaseFailed
+	s.LastError = fmt.Sprintf("%s: %s", msg, err)
+}
+
+// observe records the outcome of the full pass in 'rep'.
+func (s *runStatus) observe(rep *report) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.Passes++
+	s.LastPass = &now
+	s.DeviceMTU = rep.DeviceMTU
+	s.TunnelMTU = rep.TunnelMTU
+	s.Namespaces = resultCounts{}
+	for _, nsr := range rep.Namespaces {
+		s.Namespaces.add(nsr.changed(), nsr.Error)
+	}
+	s.HostLinks = resultCounts{}
+	for _, lr := range rep.HostLinks {
+		s.HostLinks.add(lr.Change != nil, lr.Error)
+	}
+	s.Failed = rep.Failed
+	s.LastError = rep.Error
+}
+
+// ready returns true if a full pass has completed without failures, and
+// otherwise a description of why the run is not ready. Incremental updates
+// in watch mode do not affect readiness, so it only changes on resync.
+func (s *runStatus) ready() (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.Phase == phaseFailed:
+		return false, "failed: " + s.LastError
+	case s.Passes == 0:
+		return false, s.Phase
+	case s.Failed > 0:
+		return false, fmt.Sprintf("partially failed: %d operations failed",
+			s.Failed)
+	}
+	return true, "ok"
+}
+
+func (s *runStatus) serveStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		log.WithError(err).Warn("Failed to write status")
+	}
+}
+
+func (s *runStatus) serveReady(w http.ResponseWriter, r *http.Request) {
+	ok, msg := s.ready()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, msg)
+}
+
+func serveHealthy(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// serveHealth serves the liveness, readiness and status endpoints for 's'
+// on the specified address in the background.
+//
+// /healthz succeeds as long as the process is running, /readyz succeeds
+// once a full pass has completed without failures, and /status reports the
+// phase, the outcome of the last full pass and the last error as JSON.
+func serveHealth(address string, s *runStatus) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealthy)
+	mux.HandleFunc("/readyz", s.serveReady)
+	mux.HandleFunc("/status", s.serveStatus)
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		log.WithError(err).Error("Health server stopped")
+	}()
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// nodeIPEnv is the environment variable holding the IP of the node, used to
+// find the device carrying the traffic between nodes.
+const nodeIPEnv = "NODE_IP"
+
+// addressLink returns the link out of 'links' in namespace 'ns' which holds
+// the address 'ip'.
+func addressLink(ns *namespace, links []netlink.Link, ip net.IP) (netlink.Link, error) {
+	for _, link := range links {
+		addrs, err := ns.nl.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return link, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no link has address %s", ip)
+}
+
+// findUplink returns the device in the host namespace carrying the traffic
+// of the node, and the reason it was chosen. The device is the one given
+// with --device, or else the one holding the node IP from nodeIPEnv, or else
+// the one of the default route.
+func findUplink(host *namespace, links []netlink.Link) (netlink.Link, string, error) {
+	if uplinkDevice != "" {
+		link, err := host.nl.LinkByName(uplinkDevice)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to find device %s: %s",
+				uplinkDevice, err)
+		}
+		return link, "was given with --device", nil
+	}
+
+	if value := os.Getenv(nodeIPEnv); value != "" {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, "", fmt.Errorf("invalid node IP %q in %s", value,
+				nodeIPEnv)
+		}
+		link, err := addressLink(host, links, ip)
+		if err == nil {
+			return link, fmt.Sprintf("holds node IP %s", ip), nil
+		}
+		log.WithError(err).Warn("Failed to find device of node IP, using default route")
+	}
+
+	link, err := defaultRouteLink(host)
+	if err != nil {
+		return nil, "", err
+	}
+	return link, "has the default route", nil
+}
+
+// isBridgeUplinkPort returns true if links of the specified type may connect
+// a bridge to the network, rather than to eg containers or VMs.
+func isBridgeUplinkPort(linkType string) bool {
+	switch linkType {
+	case "device", "bond", "vlan":
+		return true
+	}
+	return false
+}
+
+// uplinkLowers returns the links below 'link' which carry its traffic: the
+// lower device of VLANs and macvlans, the slaves of bonds and the ports of
+// bridges which connect to the network.
+func uplinkLowers(link netlink.Link, links []netlink.Link) []netlink.Link {
+	attrs := link.Attrs()
+	result := []netlink.Link{}
+	for _, l := range links {
+		la := l.Attrs()
+		switch link.Type() {
+		case "vlan", "macvlan":
+			if la.Index == attrs.ParentIndex {
+				result = append(result, l)
+			}
+		case "bond":
+			if la.MasterIndex == attrs.Index {
+				result = append(result, l)
+			}
+		case "bridge":
+			if la.MasterIndex == attrs.Index && isBridgeUplinkPort(l.Type()) {
+				result = append(result, l)
+			}
+		}
+	}
+	return result
+}
+
+// detectMTU finds the device carrying the traffic of the node and returns
+// the lowest MTU amongst the device and the links below it, out of the
+// provided list of links in 'host'. Returns an error if no such device can
+// be found.
+func detectMTU(host *namespace, links []netlink.Link) (int, error) {
+	log.Debug("Autodetecting MTU")
+
+	uplink, reason, err := findUplink(host, links)
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("Autodetecting MTU from device %s, which %s",
+		uplink.Attrs().Name, reason)
+
+	mtu := uplink.Attrs().MTU
+	path := []string{}
+	visited := map[int]bool{}
+	pending := []netlink.Link{uplink}
+	for len(pending) > 0 {
+		link := pending[0]
+		pending = pending[1:]
+		attrs := link.Attrs()
+		if visited[attrs.Index] {
+			continue
+		}
+		visited[attrs.Index] = true
+		path = append(path, fmt.Sprintf("%s (%s, MTU %d)", attrs.Name,
+			link.Type(), attrs.MTU))
+
+		if attrs.MTU < mtu {
+			log.Debugf("Link %s forces lower MTU %d", attrs.Name, attrs.MTU)
+			mtu = attrs.MTU
+		}
+		pending = append(pending, uplinkLowers(link, links)...)
+	}
+	log.Infof("Autodetected MTU %d over %s", mtu, strings.Join(path, ", "))
+
+	return mtu, nil
+}
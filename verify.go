@@ -0,0 +1,400 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	probeOK          = "ok"
+	probeFragNeeded  = "fragmentation-needed"
+	probeLocalTooBig = "exceeds-local-mtu"
+	probeTimeout     = "timeout"
+	probeError       = "error"
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	icmpHeaderLen = 8
+
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+
+	// pollInterval bounds how long a single receive call blocks while
+	// waiting for a probe reply.
+	pollInterval = 100 * time.Millisecond
+)
+
+// probeTarget is a destination for path MTU probes. The ifindex is used as
+// the zone of IPv6 link-local targets.
+type probeTarget struct {
+	ip      net.IP
+	ifindex int
+}
+
+// probeResult records the outcome of a single probe of a given size.
+// RouteMTU is the MTU configured for the route to the target, which probes
+// up to that size must get through.
+type probeResult struct {
+	Target   string `json:"target"`
+	Size     int    `json:"size"`
+	RouteMTU int    `json:"routeMTU,omitempty"`
+	Result   string `json:"result"`
+	MTU      int    `json:"mtu,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (p *probeResult) String() string {
+	switch p.Result {
+	case probeOK:
+		return fmt.Sprintf("%dB to %s: ok", p.Size, p.Target)
+	case probeFragNeeded:
+		return fmt.Sprintf("%dB to %s: fragmentation needed, path MTU %d",
+			p.Size, p.Target, p.MTU)
+	case probeError:
+		return fmt.Sprintf("%dB to %s: %s", p.Size, p.Target, p.Error)
+	}
+	return fmt.Sprintf("%dB to %s: %s", p.Size, p.Target, p.Result)
+}
+
+// checksum computes the Internet checksum (RFC1071) of the data.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// echoRequest builds an ICMP echo request which results in an IP packet of
+// exactly 'size' bytes. The kernel fills in the checksum for ICMPv6.
+func echoRequest(v4 bool, id, seq, size int) []byte {
+	hdrLen := ipv6HeaderLen
+	msgType := byte(icmpv6EchoRequest)
+	if v4 {
+		hdrLen = ipv4HeaderLen
+		msgType = icmpv4EchoRequest
+	}
+
+	msg := make([]byte, size-hdrLen)
+	msg[0] = msgType
+	msg[4], msg[5] = byte(id>>8), byte(id)
+	msg[6], msg[7] = byte(seq>>8), byte(seq)
+	if v4 {
+		csum := checksum(msg)
+		msg[2], msg[3] = byte(csum>>8), byte(csum)
+	}
+	return msg
+}
+
+// isEchoReply returns true if the received packet is the reply to the echo
+// request with the specified id and sequence number. Raw IPv4 sockets
+// receive the IP header along with the ICMP message.
+func isEchoReply(v4 bool, pkt []byte, id, seq int) bool {
+	replyType := byte(icmpv6EchoReply)
+	if v4 {
+		if len(pkt) < ipv4HeaderLen {
+			return false
+		}
+		pkt = pkt[int(pkt[0]&0x0f)*4:]
+		replyType = icmpv4EchoReply
+	}
+	if len(pkt) < icmpHeaderLen {
+		return false
+	}
+	return pkt[0] == replyType &&
+		int(pkt[4])<<8|int(pkt[5]) == id &&
+		int(pkt[6])<<8|int(pkt[7]) == seq
+}
+
+// readErrQueue reads the extended error reported for the socket, and
+// records it in the result. A fragmentation needed or packet too big error
+// carries the MTU of the path in the 'info' field of the extended error.
+func readErrQueue(fd int, res *probeResult) {
+	buf := make([]byte, 512)
+	oob := make([]byte, 512)
+	_, oobn, _, _, err := unix.Recvmsg(fd, buf, oob, unix.MSG_ERRQUEUE)
+	if err != nil {
+		res.Result = probeError
+		res.Error = err.Error()
+		return
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		res.Result = probeError
+		res.Error = err.Error()
+		return
+	}
+	for _, m := range msgs {
+		isErr := (m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_RECVERR) ||
+			(m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_RECVERR)
+		// struct sock_extended_err: errno(4) origin(1) type(1) code(1)
+		// pad(1) info(4) data(4)
+		if !isErr || len(m.Data) < 16 {
+			continue
+		}
+		errno := syscall.Errno(nl.NativeEndian().Uint32(m.Data[0:4]))
+		if errno == unix.EMSGSIZE {
+			res.Result = probeFragNeeded
+			res.MTU = int(nl.NativeEndian().Uint32(m.Data[8:12]))
+		} else {
+			res.Result = probeError
+			res.Error = errno.Error()
+		}
+		return
+	}
+
+	res.Result = probeError
+	res.Error = "no extended error reported"
+}
+
+// probe sends a single DF-marked ICMP echo request of 'size' bytes from
+// within the namespace towards the target, and waits up to 'timeout' for
+// either a reply or an ICMP error indicating that the packet is too big.
+func probe(ns *namespace, target probeTarget, seq, size int, timeout time.Duration) *probeResult {
+	res := &probeResult{
+		Target: target.ip.String(),
+		Size:   size,
+	}
+	v4 := target.ip.To4() != nil
+
+	var (
+		fd  int
+		err error
+		to  unix.Sockaddr
+	)
+	if v4 {
+		fd, err = ns.socket(unix.AF_INET, unix.SOCK_RAW|unix.SOCK_CLOEXEC,
+			unix.IPPROTO_ICMP)
+		if err == nil {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IP,
+				unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+		}
+		if err == nil {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IP,
+				unix.IP_RECVERR, 1)
+		}
+		sa := &unix.SockaddrInet4{}
+		copy(sa.Addr[:], target.ip.To4())
+		to = sa
+	} else {
+		fd, err = ns.socket(unix.AF_INET6, unix.SOCK_RAW|unix.SOCK_CLOEXEC,
+			unix.IPPROTO_ICMPV6)
+		if err == nil {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6,
+				unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+		}
+		if err == nil {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6,
+				unix.IPV6_RECVERR, 1)
+		}
+		sa := &unix.SockaddrInet6{}
+		copy(sa.Addr[:], target.ip.To16())
+		if target.ip.IsLinkLocalUnicast() {
+			sa.ZoneId = uint32(target.ifindex)
+		}
+		to = sa
+	}
+	if fd >= 0 {
+		defer unix.Close(fd)
+	}
+	if err == nil {
+		tv := unix.NsecToTimeval(pollInterval.Nanoseconds())
+		err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+	}
+	if err != nil {
+		res.Result = probeError
+		res.Error = fmt.Sprintf("failed to open socket: %s", err)
+		return res
+	}
+
+	id := os.Getpid() & 0xffff
+	if err := unix.Sendto(fd, echoRequest(v4, id, seq, size), 0, to); err != nil {
+		if err == unix.EMSGSIZE {
+			res.Result = probeLocalTooBig
+		} else {
+			res.Result = probeError
+			res.Error = err.Error()
+		}
+		return res
+	}
+
+	buf := make([]byte, size+ipv6HeaderLen)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		switch err {
+		case nil:
+			if isEchoReply(v4, buf[:n], id, seq) {
+				res.Result = probeOK
+				return res
+			}
+		case unix.EAGAIN, unix.EINTR:
+		default:
+			// An ICMP error was received for the probe.
+			readErrQueue(fd, res)
+			return res
+		}
+	}
+
+	res.Result = probeTimeout
+	return res
+}
+
+// getProbeTargets returns the targets to probe from within the namespace,
+// either the configured targets, or the addresses on other nodes found in
+// 'epInfo' along with the gateways of the default routes. The gateway is
+// usually on the node itself, so is only probed as a sanity check of the
+// local path, while the other nodes are reached across the network.
+func getProbeTargets(ns *namespace, epInfo *endpointInfo) ([]probeTarget, error) {
+	if len(verifyTargets) > 0 {
+		targets := make([]probeTarget, 0, len(verifyTargets))
+		for _, t := range verifyTargets {
+			ip := net.ParseIP(t)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid verification target %q", t)
+			}
+			targets = append(targets, probeTarget{ip: ip})
+		}
+		return targets, nil
+	}
+
+	routes, err := getDefaultRoutes(ns, nil)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]probeTarget, 0, len(routes)+len(epInfo.remoteTargets))
+	for _, ip := range epInfo.remoteTargets {
+		targets = append(targets, probeTarget{ip: ip})
+	}
+	for _, r := range routes {
+		if r.Gw != nil {
+			targets = append(targets, probeTarget{
+				ip:      r.Gw,
+				ifindex: r.LinkIndex,
+			})
+		}
+	}
+	return targets, nil
+}
+
+// targetRoute returns the most specific unicast route in the namespace
+// which covers 'ip'. Returns an error if there is no such route.
+func targetRoute(ns *namespace, ip net.IP) (*netlink.Route, error) {
+	family := netlink.FAMILY_V6
+	if ip.To4() != nil {
+		family = netlink.FAMILY_V4
+	}
+	routes, err := ns.nl.RouteList(nil, family)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		result *netlink.Route
+		best   = -1
+	)
+	for i := range routes {
+		r := &routes[i]
+		if r.Type != unix.RTN_UNICAST {
+			continue
+		}
+		ones := 0
+		if !isDefault(r) {
+			if !r.Dst.Contains(ip) {
+				continue
+			}
+			ones, _ = r.Dst.Mask.Size()
+		}
+		if ones > best {
+			result, best = r, ones
+		}
+	}
+	if result == nil {
+		return nil, fmt.Errorf("no route to %s", ip)
+	}
+	return result, nil
+}
+
+// verifyNamespace probes the path MTU from within the namespace, and records
+// the results in 'nsr'. Each target is probed with packets of the MTU
+// configured for the route to it according to its class, and of the device
+// MTU if larger, which is expected to be refused. Returns an error if any
+// of the probes up to the route MTU did not get through.
+func verifyNamespace(ns *namespace, deviceMTU, tunnelMTU int, epInfo *endpointInfo, nsr *nsReport) error {
+	targets, err := getProbeTargets(ns, epInfo)
+	if err != nil {
+		return fmt.Errorf("failed to find verification targets: %s", err)
+	}
+
+	failed := 0
+	for _, target := range targets {
+		route, err := targetRoute(ns, target.ip)
+		if err != nil {
+			nsr.Probes = append(nsr.Probes, &probeResult{
+				Target: target.ip.String(),
+				Result: probeError,
+				Error:  err.Error(),
+			})
+			failed++
+			ns.log.WithError(err).Warnf("Cannot probe %s", target.ip)
+			continue
+		}
+		routeMTU := routeClassMTU(classifyRoute(route, epInfo), deviceMTU,
+			tunnelMTU)
+
+		sizes := []int{routeMTU}
+		if deviceMTU > routeMTU {
+			sizes = append(sizes, deviceMTU)
+		}
+		for i, size := range sizes {
+			res := probe(ns, target, i+1, size, verifyTimeout)
+			res.RouteMTU = routeMTU
+			nsr.Probes = append(nsr.Probes, res)
+			switch {
+			case res.Result == probeOK:
+				ns.log.Debugf("Probe %s", res)
+			case size > routeMTU:
+				ns.log.Debugf("Probe %s, as expected above route MTU %d",
+					res, routeMTU)
+			default:
+				failed++
+				ns.log.Warnf("Probe %s", res)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d/%d MTU probes failed", failed, len(nsr.Probes))
+	}
+
+	return nil
+}
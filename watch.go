@@ -0,0 +1,232 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// settleDelay is how long to wait after the first link event before
+	// reconciling, so that links created together are handled together.
+	settleDelay = time.Second
+
+	// retryInterval is how long to wait before retrying links which were
+	// not yet known to Cilium when they were first seen.
+	retryInterval = 5 * time.Second
+
+	// maxRetries is the number of times a link which is not known to
+	// Cilium is retried before leaving it to the next full resync.
+	maxRetries = 12
+)
+
+// watcher reconciles the MTU of links and namespaces as they are created,
+// based on link events in the host namespace.
+type watcher struct {
+	host      *namespace
+	deviceMTU int
+	tunnelMTU int
+
+	updates chan netlink.LinkUpdate
+	done    chan struct{}
+
+	// known is the set of namespace inodes which have been handled, and
+	// do not need to be reconciled again until the next full resync.
+	known map[uint64]struct{}
+
+	// pending maps the ifindex of host links which need to be
+	// reconciled to the number of attempts made so far.
+	pending map[int]int
+}
+
+// newWatcher subscribes to link events in the host namespace. Events are
+// queued until run() is called, so that links created while performing the
+// initial update are not missed.
+func newWatcher(host *namespace, deviceMTU, tunnelMTU int) (*watcher, error) {
+	w := &watcher{
+		host:      host,
+		deviceMTU: deviceMTU,
+		tunnelMTU: tunnelMTU,
+		updates:   make(chan netlink.LinkUpdate, 64),
+		done:      make(chan struct{}),
+		known:     make(map[uint64]struct{}),
+		pending:   make(map[int]int),
+	}
+	if err := netlink.LinkSubscribe(w.updates, w.done); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Close stops the link subscription.
+func (w *watcher) Close() {
+	close(w.done)
+}
+
+// needsUpdate returns true if the link from the update is a pod link or a
+// cilium device which does not have the desired MTU.
+func (w *watcher) needsUpdate(u *netlink.LinkUpdate) bool {
+	if u.Header.Type != unix.RTM_NEWLINK || u.Link == nil {
+		return false
+	}
+	attrs := u.Link.Attrs()
+	if rule, ok := lookupDeviceRule(attrs.Name); ok {
+		return rule.kind != ruleSkip &&
+			attrs.MTU != rule.targetMTU(w.deviceMTU, w.tunnelMTU)
+	}
+	return isPodLinkType(u.Link.Type()) && attrs.MTU != w.deviceMTU
+}
+
+// markKnown adds all namespaces which need no further attention in 'rep' to
+// the set of known namespaces.
+func (w *watcher) markKnown(rep *report) {
+	for _, nsr := range rep.Namespaces {
+		if nsr.done() {
+			w.known[nsr.Inode] = struct{}{}
+		}
+	}
+}
+
+// reconcile updates all namespaces which have not yet been handled, and the
+// host links which are pending. Links which are not yet managed by Cilium
+// remain pending until they have been retried maxRetries times.
+func (w *watcher) reconcile() error {
+	start := time.Now()
+
+	epInfo, err := getEndpoints()
+	if err != nil {
+		return fmt.Errorf("failed to fetch Cilium endpoints: %s", err)
+	}
+
+	rootNamespace, namespaces, err := scanNamespaces()
+	if err != nil {
+		return fmt.Errorf("failed to find network namespaces: %s", err)
+	}
+	defer closeNamespaces(rootNamespace, namespaces)
+
+	newNamespaces := make([]*namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if _, ok := w.known[ns.inode]; !ok {
+			newNamespaces = append(newNamespaces, ns)
+		}
+	}
+
+	hostLinks, err := scanLinks(w.host)
+	if err != nil {
+		return fmt.Errorf("failed to scan available links: %s", err)
+	}
+
+	links := make([]netlink.Link, 0, len(w.pending))
+	for ifindex := range w.pending {
+		link, err := w.host.nl.LinkByIndex(ifindex)
+		if err != nil {
+			log.WithField("ifindex", ifindex).Debug("Link disappeared")
+			delete(w.pending, ifindex)
+			continue
+		}
+		links = append(links, link)
+	}
+
+	rep := newReport(w.deviceMTU, w.tunnelMTU)
+	peers := newHostPeers(w.host, hostLinks)
+	failed, err := updateLinks(w.host, links, w.deviceMTU, w.tunnelMTU, rep,
+		nil, func() (int, error) {
+			return updateNamespaceList(newNamespaces, w.deviceMTU,
+				w.tunnelMTU, epInfo, peers, rep, nil), nil
+		})
+	rep.Failed = failed
+	runMetrics.observe(passIncremental, rep, time.Since(start))
+	if err != nil {
+		return fmt.Errorf("failed to update new links: %s", err)
+	}
+	w.markKnown(rep)
+	if failed > 0 {
+		log.Warnf("%d MTU update operations failed on new links, retrying on resync",
+			failed)
+	}
+
+	for _, lr := range rep.HostLinks {
+		w.pending[lr.Ifindex]++
+		if lr.Skipped == skipNotManaged && w.pending[lr.Ifindex] < maxRetries {
+			continue
+		}
+		delete(w.pending, lr.Ifindex)
+	}
+
+	return nil
+}
+
+// resync performs a full update of all namespaces and host links, and
+// resets the set of known namespaces.
+func (w *watcher) resync() error {
+	rep := newReport(w.deviceMTU, w.tunnelMTU)
+	if _, err := updateAll(w.host, rep); err != nil {
+		return err
+	}
+	writeReports(rep)
+	w.known = make(map[uint64]struct{})
+	w.markKnown(rep)
+	return nil
+}
+
+// run handles link events until the subscription fails, reconciling new
+// links and namespaces as they appear, and performing a full resync every
+// 'interval'. Namespaces handled in 'initial' are not reconciled again until
+// the first resync.
+func (w *watcher) run(initial *report, interval time.Duration) error {
+	w.markKnown(initial)
+
+	resyncTicker := time.NewTicker(interval)
+	defer resyncTicker.Stop()
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case u, ok := <-w.updates:
+			if !ok {
+				return fmt.Errorf("link subscription closed")
+			}
+			if !w.needsUpdate(&u) {
+				continue
+			}
+			log.Debugf("Link %s created with MTU %d",
+				u.Link.Attrs().Name, u.Link.Attrs().MTU)
+			if _, ok := w.pending[u.Link.Attrs().Index]; !ok {
+				w.pending[u.Link.Attrs().Index] = 0
+			}
+			if retry == nil {
+				retry = time.After(settleDelay)
+			}
+		case <-retry:
+			retry = nil
+			if err := w.reconcile(); err != nil {
+				log.WithError(err).Warn("Failed to reconcile new links")
+			}
+			if len(w.pending) > 0 {
+				retry = time.After(retryInterval)
+			}
+		case <-resyncTicker.C:
+			log.Debug("Performing full resync")
+			if err := w.resync(); err != nil {
+				log.WithError(err).Warn("Failed to resync")
+				runState.setError(err, "Failed to resync")
+			}
+		}
+	}
+}